@@ -0,0 +1,136 @@
+package migration
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// A Checkpoint is a single migration that creates the database schema
+// as at a version, in place of all of the up migrations to that version.
+// Checkpoints are created using the schema's Checkpoint method.
+type Checkpoint struct {
+	id    VersionID
+	sql   string
+	count int
+}
+
+// Checkpoint defines a checkpoint at the database schema version id,
+// which must also be defined using Define. When a worker migrates up a
+// database that has no applied versions, it performs the checkpoint
+// migration, and records all versions up to and including id as applied,
+// without performing their individual up migrations. A database that has
+// already applied any version ignores the checkpoint.
+//
+// It is not possible to migrate down from a version at or below the
+// checkpoint.
+func (s *Schema) Checkpoint(id VersionID) *Checkpoint {
+	if s.checkpoint != nil {
+		s.errs = append(s.errs, &Error{
+			Version:     id,
+			Description: "checkpoint defined more than once",
+		})
+	}
+	s.checkpoint = &Checkpoint{id: id}
+	return s.checkpoint
+}
+
+// Up defines the SQL to create the database schema as at the
+// checkpoint version.
+func (c *Checkpoint) Up(sql string) *Checkpoint {
+	c.count++
+	c.sql = sql
+	return c
+}
+
+func (c *Checkpoint) errs(s *Schema) Errors {
+	var errs Errors
+	addError := func(s string) {
+		errs = append(errs, &Error{
+			Version:     c.id,
+			Description: s,
+		})
+	}
+	if _, ok := s.definitions[c.id]; !ok {
+		addError("checkpoint version not defined")
+	}
+	if c.count == 0 {
+		addError("checkpoint up migration not defined")
+	}
+	if c.count > 1 {
+		addError(fmt.Sprintf("checkpoint up migration defined %d times", c.count))
+	}
+	return errs
+}
+
+// applyCheckpoint performs the schema's checkpoint migration if the
+// database has no applied versions, and the migration target is at or
+// above the checkpoint. A target of zero means the latest version.
+func (m *Worker) applyCheckpoint(ctx context.Context, target VersionID) error {
+	cp := m.schema.checkpoint
+	if cp == nil || (target != 0 && target < cp.id) {
+		return nil
+	}
+
+	var fresh bool
+	insertVersions := func(tx *sql.Tx) error {
+		now := time.Now()
+		for _, plan := range m.schema.plans {
+			if plan.id > cp.id {
+				break
+			}
+			ver := &Version{
+				ID:          plan.id,
+				AppliedAt:   &now,
+				Locked:      m.AutoLock,
+				Environment: m.Environment,
+				AppliedBy:   m.appliedBy(),
+			}
+			if err := m.insertVersion(ctx, tx, plan, ver); err != nil {
+				return wrapf(err, "%d", plan.id)
+			}
+		}
+		return nil
+	}
+
+	err := m.migrationTx(ctx, func(tx *sql.Tx) error {
+		// reset in case the transaction is retried
+		fresh = false
+		versions, err := m.listVersions(ctx, tx)
+		if err != nil {
+			return err
+		}
+		if len(versions) > 0 {
+			return nil
+		}
+		fresh = true
+		if !m.drv.SupportsTransactionalDDL() {
+			// performed outside of the transaction
+			return nil
+		}
+		if err = m.execSQL(ctx, tx, cp.sql); err != nil {
+			return wrapf(err, "checkpoint %d", cp.id)
+		}
+		return insertVersions(tx)
+	})
+	if err != nil || !fresh {
+		return err
+	}
+
+	if !m.drv.SupportsTransactionalDDL() {
+		if err = m.execNoTx(ctx, cp.sql); err != nil {
+			return wrapf(err, "checkpoint %d", cp.id)
+		}
+		if err = m.transact(ctx, insertVersions); err != nil {
+			return err
+		}
+	}
+	m.log(fmt.Sprintf("migrated up checkpoint version=%d", cp.id))
+	for _, plan := range m.schema.plans {
+		if plan.id <= cp.id {
+			m.runChanged = append(m.runChanged, plan.id)
+		}
+	}
+	return nil
+}
@@ -3,8 +3,14 @@
 package cli
 
 import (
+	"bufio"
 	"context"
+	"database/sql"
+	"encoding/json"
 	"fmt"
+	"io"
+	"os"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -17,13 +23,32 @@ import (
 // NewWorkerFunc is called to creata a migration worker.
 type NewWorkerFunc func() (*migration.Worker, error)
 
+// An Option customizes the command returned by MigrateCommand.
+type Option func(*cobra.Command)
+
+// WithUse sets the one-line usage message of the command, the first
+// word of which is the command name. The default is "migrate".
+func WithUse(use string) Option {
+	return func(cmd *cobra.Command) {
+		cmd.Use = use
+	}
+}
+
+// WithShort sets the short description of the command shown in
+// help output. The default is "database migrations".
+func WithShort(short string) Option {
+	return func(cmd *cobra.Command) {
+		cmd.Short = short
+	}
+}
+
 // MigrateCommand returns a cobra command that can be integrated
 // into a command line program.
 //
 // Pass context.Background() for the  context, or alternatively
 // pass a context that will cancel when the user interrupts by
 // pressing Ctrl-C or similar.
-func MigrateCommand(ctx context.Context, f NewWorkerFunc) *cobra.Command {
+func MigrateCommand(ctx context.Context, f NewWorkerFunc, opts ...Option) *cobra.Command {
 	cmd := &cobra.Command{
 		Short: "database migrations",
 		Use:   "migrate",
@@ -31,6 +56,9 @@ func MigrateCommand(ctx context.Context, f NewWorkerFunc) *cobra.Command {
 			return cmd.Help()
 		},
 	}
+	for _, opt := range opts {
+		opt(cmd)
+	}
 
 	f2 := func() (*migration.Worker, error) {
 		w, err := f()
@@ -51,10 +79,52 @@ func MigrateCommand(ctx context.Context, f NewWorkerFunc) *cobra.Command {
 	cmd.AddCommand(unlockCommand(ctx, f2))
 	cmd.AddCommand(listCommand(ctx, f2))
 	cmd.AddCommand(showCommand(ctx, f2))
+	cmd.AddCommand(statusCommand(ctx, f2))
+	return cmd
+}
+
+// MigrateCommandDSN returns a cobra command for performing database
+// migrations on the database identified by the database/sql driver name
+// and data source name. The database is opened when a command needs it,
+// and closed once the command has finished.
+//
+// Use MigrateCommand instead when more control is needed over how the
+// database is opened or how the worker is configured.
+func MigrateCommandDSN(ctx context.Context, driverName, dsn string, schema *migration.Schema, opts ...Option) *cobra.Command {
+	var db *sql.DB
+	f := func() (*migration.Worker, error) {
+		if db == nil {
+			var err error
+			if db, err = sql.Open(driverName, dsn); err != nil {
+				return nil, err
+			}
+		}
+		return migration.NewWorker(db, schema)
+	}
+
+	cmd := MigrateCommand(ctx, f, opts...)
+	for _, sub := range cmd.Commands() {
+		runE := sub.RunE
+		sub.RunE = func(cmd *cobra.Command, args []string) error {
+			defer func() {
+				if db != nil {
+					// cannot report an error closing the database
+					db.Close()
+					db = nil
+				}
+			}()
+			return runE(cmd, args)
+		}
+	}
 	return cmd
 }
 
 func upCommand(ctx context.Context, f NewWorkerFunc) *cobra.Command {
+	var flags struct {
+		runID    string
+		yes      bool
+		autoLock bool
+	}
 	cmd := &cobra.Command{
 		Short:   "migrate up",
 		Long:    "apply all database migrations",
@@ -65,13 +135,28 @@ func upCommand(ctx context.Context, f NewWorkerFunc) *cobra.Command {
 			if err != nil {
 				return err
 			}
+			if flags.runID != "" {
+				m.RunID = flags.runID
+			}
+			if flags.autoLock {
+				m.AutoLock = true
+			}
+			if !flags.yes && m.Confirm == nil {
+				m.Confirm = terminalConfirm(cmd)
+			}
 			return m.Up(ctx)
 		},
 	}
+	cmd.Flags().StringVar(&flags.runID, "run-id", "", "do nothing if a run with this id has completed")
+	cmd.Flags().BoolVar(&flags.autoLock, "auto-lock", false, "lock each version after it is applied")
+	cmd.Flags().BoolVarP(&flags.yes, "yes", "y", false, "do not prompt for confirmation")
 	return cmd
 }
 
 func downCommand(ctx context.Context, f NewWorkerFunc) *cobra.Command {
+	var flags struct {
+		force bool
+	}
 	cmd := &cobra.Command{
 		Short:   "migrate down",
 		Long:    "rollback all database migrations",
@@ -82,13 +167,20 @@ func downCommand(ctx context.Context, f NewWorkerFunc) *cobra.Command {
 			if err != nil {
 				return err
 			}
+			if flags.force {
+				return m.ForceDown(ctx)
+			}
 			return m.Down(ctx)
 		},
 	}
+	cmd.Flags().BoolVar(&flags.force, "force", false, "rollback locked versions")
 	return cmd
 }
 
 func gotoCommand(ctx context.Context, f NewWorkerFunc) *cobra.Command {
+	var flags struct {
+		yes bool
+	}
 	cmd := &cobra.Command{
 		Short:   "migrate to version",
 		Long:    "migrate up or down to a specific version",
@@ -103,13 +195,49 @@ func gotoCommand(ctx context.Context, f NewWorkerFunc) *cobra.Command {
 			if err != nil {
 				return err
 			}
+			if !flags.yes && m.Confirm == nil {
+				m.Confirm = terminalConfirm(cmd)
+			}
 			return m.Goto(ctx, id)
 		},
 	}
+	cmd.Flags().BoolVarP(&flags.yes, "yes", "y", false, "do not prompt for confirmation")
 	return cmd
 }
 
+// terminalConfirm returns a function that prompts the user to confirm
+// the migration steps, or nil if the command input is not a terminal.
+func terminalConfirm(cmd *cobra.Command) func([]*migration.PlannedStep) (bool, error) {
+	in, ok := cmd.InOrStdin().(*os.File)
+	if !ok {
+		return nil
+	}
+	if fi, err := in.Stat(); err != nil || fi.Mode()&os.ModeCharDevice == 0 {
+		return nil
+	}
+	return func(steps []*migration.PlannedStep) (bool, error) {
+		return prompt(cmd, in, steps)
+	}
+}
+
+// prompt lists the migration steps and reads the user's confirmation.
+func prompt(cmd *cobra.Command, in io.Reader, steps []*migration.PlannedStep) (bool, error) {
+	for _, step := range steps {
+		cmd.Printf("migrate %s version=%d\n", step.Direction, step.ID)
+	}
+	cmd.Printf("apply %d migrations? [y/N] ", len(steps))
+	line, err := bufio.NewReader(in).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return false, err
+	}
+	answer := strings.ToLower(strings.TrimSpace(line))
+	return answer == "y" || answer == "yes", nil
+}
+
 func forceCommand(ctx context.Context, f NewWorkerFunc) *cobra.Command {
+	var flags struct {
+		yes bool
+	}
 	cmd := &cobra.Command{
 		Short:   "force version",
 		Long:    "force the database schema version after an error",
@@ -124,9 +252,23 @@ func forceCommand(ctx context.Context, f NewWorkerFunc) *cobra.Command {
 			if err != nil {
 				return err
 			}
+			deleted, cleared, err := m.ForcePlan(ctx, id)
+			if err != nil {
+				return err
+			}
+			for _, v := range deleted {
+				cmd.Printf("delete version=%d\n", v)
+			}
+			for _, v := range cleared {
+				cmd.Printf("clear failure version=%d\n", v)
+			}
+			if !flags.yes {
+				return fmt.Errorf("use --yes to force version %d", id)
+			}
 			return m.Force(ctx, id)
 		},
 	}
+	cmd.Flags().BoolVarP(&flags.yes, "yes", "y", false, "force without confirmation")
 	return cmd
 }
 func lockCommand(ctx context.Context, f NewWorkerFunc) *cobra.Command {
@@ -198,6 +340,9 @@ func showCommand(ctx context.Context, f NewWorkerFunc) *cobra.Command {
 			if ver.Locked {
 				cmd.Print(" Locked")
 			}
+			if ver.Skipped {
+				cmd.Print(" Skipped")
+			}
 			cmd.Println()
 			cmd.Println("Up\n--")
 			cmd.Println(strings.TrimSpace(ver.Up))
@@ -210,9 +355,44 @@ func showCommand(ctx context.Context, f NewWorkerFunc) *cobra.Command {
 	return cmd
 }
 
+func statusCommand(ctx context.Context, f NewWorkerFunc) *cobra.Command {
+	cmd := &cobra.Command{
+		Short:   "show status",
+		Long:    "show the current database schema version and pending migrations",
+		Use:     "status",
+		PreRunE: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			m, err := f()
+			if err != nil {
+				return err
+			}
+			status, err := m.Status(ctx)
+			if err != nil {
+				return err
+			}
+			cmd.Printf("current version: %d\n", status.Current)
+			if status.Failed {
+				cmd.Println("database has a failed version")
+			}
+			if status.Locked != 0 {
+				cmd.Printf("locked version: %d\n", status.Locked)
+			}
+			if status.Pending == 0 {
+				cmd.Println("database is up to date")
+			} else {
+				cmd.Printf("pending migrations: %d\n", status.Pending)
+			}
+			return nil
+		},
+	}
+	return cmd
+}
+
 func listCommand(ctx context.Context, f NewWorkerFunc) *cobra.Command {
 	var flags struct {
-		all bool
+		all     bool
+		columns string
+		output  string
 	}
 	cmd := &cobra.Command{
 		Short:   "list versions",
@@ -242,31 +422,41 @@ func listCommand(ctx context.Context, f NewWorkerFunc) *cobra.Command {
 				}
 				var vcopy []*migration.Version
 				for i, ver := range versions {
-					if i >= start || ver.AppliedAt == nil {
+					if i >= start || !ver.Applied {
 						vcopy = append(vcopy, ver)
 					}
 				}
 				versions = vcopy
 			}
 
+			switch flags.output {
+			case "table":
+			case "json":
+				if versions == nil {
+					versions = []*migration.Version{}
+				}
+				enc := json.NewEncoder(cmd.OutOrStdout())
+				enc.SetIndent("", "  ")
+				return enc.Encode(versions)
+			default:
+				return fmt.Errorf("invalid output format: %s", flags.output)
+			}
+
+			var columns []string
+			for _, column := range strings.Split(flags.columns, ",") {
+				column = strings.TrimSpace(column)
+				if listColumns[column] == nil {
+					return fmt.Errorf("invalid column: %s", column)
+				}
+				columns = append(columns, column)
+			}
+
 			w := tablewriter.NewWriter(cmd.OutOrStderr())
-			w.SetHeader([]string{"id", "applied", "status"})
+			w.SetHeader(columns)
 			for _, ver := range versions {
 				var row []string
-				row = append(row, fmt.Sprint(ver.ID))
-				if ver.AppliedAt == nil {
-					row = append(row, "")
-				} else {
-					row = append(row, (*ver.AppliedAt).Format(time.RFC3339))
-				}
-				if ver.Failed {
-					row = append(row, "failed")
-				} else if ver.Locked {
-					row = append(row, "locked")
-				} else if ver.AppliedAt != nil {
-					row = append(row, "ok")
-				} else {
-					row = append(row, "")
+				for _, column := range columns {
+					row = append(row, listColumns[column](ver))
 				}
 				w.Append(row)
 			}
@@ -275,9 +465,63 @@ func listCommand(ctx context.Context, f NewWorkerFunc) *cobra.Command {
 		},
 	}
 	cmd.Flags().BoolVarP(&flags.all, "all", "a", false, "list all versions")
+	cmd.Flags().StringVar(&flags.columns, "columns", "id,name,applied,status", "comma-separated list of columns: "+listColumnNames())
+	cmd.Flags().StringVarP(&flags.output, "output", "o", "table", "output format: table, json")
 	return cmd
 }
 
+// listColumns maps the name of each column available to the list
+// command to a function that formats the column for a version.
+var listColumns = map[string]func(ver *migration.Version) string{
+	"id": func(ver *migration.Version) string {
+		return fmt.Sprint(ver.ID)
+	},
+	"applied": func(ver *migration.Version) string {
+		if ver.AppliedAt == nil {
+			return ""
+		}
+		return (*ver.AppliedAt).Format(time.RFC3339)
+	},
+	"status": func(ver *migration.Version) string {
+		if ver.Failed {
+			return "failed"
+		} else if ver.Locked {
+			return "locked"
+		} else if ver.Skipped {
+			return "skipped"
+		} else if ver.Warning != "" {
+			return "warning"
+		} else if ver.Applied {
+			return "ok"
+		}
+		return ""
+	},
+	"environment": func(ver *migration.Version) string {
+		return ver.Environment
+	},
+	"duration": func(ver *migration.Version) string {
+		if !ver.Applied {
+			return ""
+		}
+		return ver.Duration.String()
+	},
+	"author": func(ver *migration.Version) string {
+		return ver.AppliedBy
+	},
+	"name": func(ver *migration.Version) string {
+		return ver.Name
+	},
+}
+
+func listColumnNames() string {
+	var names []string
+	for name := range listColumns {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
 func parseVersion(s string) (migration.VersionID, error) {
 	n, err := strconv.ParseInt(s, 10, 64)
 	if err != nil {
@@ -0,0 +1,364 @@
+package cli
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jjeffery/migration"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/spf13/cobra"
+)
+
+func TestMigrateCommandOptions(t *testing.T) {
+	ctx := context.Background()
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	newWorker := func() (*migration.Worker, error) {
+		return migration.NewWorker(db, newTestSchema())
+	}
+
+	root := &cobra.Command{Use: "db"}
+	cmd := MigrateCommand(ctx, newWorker, WithUse("schema"), WithShort("schema migrations"))
+	root.AddCommand(cmd)
+
+	if got, want := cmd.Name(), "schema"; got != want {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+	if got, want := cmd.Short, "schema migrations"; got != want {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+
+	out := execute(t, root, "schema", "up")
+	if got, want := out, "migrate up finished version=1"; !strings.Contains(got, want) {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+}
+
+func TestUpRunID(t *testing.T) {
+	ctx := context.Background()
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	newWorker := func() (*migration.Worker, error) {
+		return migration.NewWorker(db, newTestSchema())
+	}
+	worker, err := newWorker()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := execute(t, MigrateCommand(ctx, newWorker), "up", "--run-id", "abc")
+	if got, want := out, "migrate up finished version=1"; !strings.Contains(got, want) {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+
+	// roll back so that a second up would have work to do
+	if err = worker.Goto(ctx, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	out = execute(t, MigrateCommand(ctx, newWorker), "up", "--run-id", "abc")
+	if got, want := out, "run already completed run_id=abc"; !strings.Contains(got, want) {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+	ver, err := worker.Version(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ver.AppliedAt != nil {
+		t.Errorf("got=%v, want=nil", *ver.AppliedAt)
+	}
+}
+
+func TestForceYes(t *testing.T) {
+	ctx := context.Background()
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	newWorker := func() (*migration.Worker, error) {
+		return migration.NewWorker(db, newTestSchema())
+	}
+	worker, err := newWorker()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = worker.Up(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	cmd := MigrateCommand(ctx, newWorker)
+	cmd.SetOutput(&buf)
+	cmd.SetArgs([]string{"force", "0"})
+	if err := cmd.Execute(); err == nil || err.Error() != "use --yes to force version 0" {
+		t.Errorf("got=%v, want=use --yes to force version 0", err)
+	}
+	if got, want := buf.String(), "delete version=1\n"; !strings.HasPrefix(got, want) {
+		t.Errorf("got=%q, want prefix %q", got, want)
+	}
+	if ver, err := worker.Version(ctx, 1); err != nil || ver.AppliedAt == nil {
+		t.Errorf("got=%v, want version 1 applied", err)
+	}
+
+	out := execute(t, MigrateCommand(ctx, newWorker), "force", "0", "--yes")
+	if got, want := out, "delete version=1"; !strings.Contains(got, want) {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+	if ver, err := worker.Version(ctx, 1); err != nil || ver.AppliedAt != nil {
+		t.Errorf("got=%v, want version 1 unapplied", err)
+	}
+}
+
+func TestListColumns(t *testing.T) {
+	ctx := context.Background()
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	newWorker := func() (*migration.Worker, error) {
+		w, err := migration.NewWorker(db, newTestSchema())
+		if err != nil {
+			return nil, err
+		}
+		w.Environment = "test"
+		w.AppliedBy = "ci"
+		return w, nil
+	}
+
+	execute(t, MigrateCommand(ctx, newWorker), "up")
+	out := execute(t, MigrateCommand(ctx, newWorker), "list", "--columns", "status,id,environment")
+
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	if got, want := len(lines), 5; got != want {
+		t.Fatalf("got=%v, want=%v\n%s", got, want, out)
+	}
+	if got, want := strings.Join(strings.Fields(lines[1]), " "), "| STATUS | ID | ENVIRONMENT |"; got != want {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+	if got, want := strings.Join(strings.Fields(lines[3]), " "), "| ok | 1 | test |"; got != want {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+
+	out = execute(t, MigrateCommand(ctx, newWorker), "list", "--columns", "id,duration")
+	lines = strings.Split(strings.TrimSpace(out), "\n")
+	if got, want := strings.Join(strings.Fields(lines[1]), " "), "| ID | DURATION |"; got != want {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+	if fields := strings.Fields(lines[3]); len(fields) != 5 {
+		t.Errorf("got=%v, want a duration", lines[3])
+	} else if _, err := time.ParseDuration(fields[3]); err != nil {
+		t.Errorf("got=%v, want a duration", fields[3])
+	}
+
+	out = execute(t, MigrateCommand(ctx, newWorker), "list", "--columns", "id,author")
+	lines = strings.Split(strings.TrimSpace(out), "\n")
+	if got, want := strings.Join(strings.Fields(lines[3]), " "), "| 1 | ci |"; got != want {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+
+	cmd := MigrateCommand(ctx, newWorker)
+	cmd.SetOutput(&bytes.Buffer{})
+	cmd.SetArgs([]string{"list", "--columns", "id,bogus"})
+	if err := cmd.Execute(); err == nil || err.Error() != "invalid column: bogus" {
+		t.Errorf("got=%v, want=invalid column: bogus", err)
+	}
+}
+
+func TestListName(t *testing.T) {
+	ctx := context.Background()
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	newWorker := func() (*migration.Worker, error) {
+		schema := newTestSchema()
+		schema.Define(2).Name("add t2").
+			Up(`create table t2(id int primary key);`).
+			Down(`drop table t2;`)
+		return migration.NewWorker(db, schema)
+	}
+
+	out := execute(t, MigrateCommand(ctx, newWorker), "list")
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	if got, want := len(lines), 6; got != want {
+		t.Fatalf("got=%v, want=%v\n%s", got, want, out)
+	}
+	if got, want := strings.Join(strings.Fields(lines[1]), " "), "| ID | NAME | APPLIED | STATUS |"; got != want {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+	if got, want := strings.Join(strings.Fields(lines[4]), " "), "| 2 | add t2 | | |"; got != want {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+}
+
+func TestListJSON(t *testing.T) {
+	ctx := context.Background()
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	newWorker := func() (*migration.Worker, error) {
+		schema := newTestSchema()
+		schema.Define(2).
+			Up(`create table t2(id int primary key);`).
+			Down(`drop table t2;`)
+		return migration.NewWorker(db, schema)
+	}
+
+	execute(t, MigrateCommand(ctx, newWorker), "goto", "1", "--yes")
+	out := execute(t, MigrateCommand(ctx, newWorker), "list", "--output", "json")
+	start := strings.Index(out, "[")
+	if start < 0 {
+		t.Fatalf("got=%v, want JSON array", out)
+	}
+	var versions []struct {
+		ID        migration.VersionID `json:"id"`
+		AppliedAt *time.Time          `json:"applied_at"`
+		Failed    bool                `json:"failed"`
+		Locked    bool                `json:"locked"`
+	}
+	if err = json.Unmarshal([]byte(out[start:]), &versions); err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+	if got, want := len(versions), 2; got != want {
+		t.Fatalf("got=%v, want=%v", got, want)
+	}
+	if versions[0].ID != 1 || versions[0].AppliedAt == nil {
+		t.Errorf("got=%+v, want version 1 applied", versions[0])
+	}
+	if versions[1].ID != 2 || versions[1].AppliedAt != nil {
+		t.Errorf("got=%+v, want version 2 unapplied", versions[1])
+	}
+}
+
+func TestStatus(t *testing.T) {
+	ctx := context.Background()
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	newWorker := func() (*migration.Worker, error) {
+		schema := newTestSchema()
+		schema.Define(2).
+			Up(`create table t2(id int primary key);`).
+			Down(`drop table t2;`)
+		return migration.NewWorker(db, schema)
+	}
+
+	execute(t, MigrateCommand(ctx, newWorker), "goto", "1", "--yes")
+	execute(t, MigrateCommand(ctx, newWorker), "lock", "1")
+	out := execute(t, MigrateCommand(ctx, newWorker), "status")
+	if got, want := out, "current version: 1\nlocked version: 1\npending migrations: 1\n"; got != want {
+		t.Errorf("got=%q, want=%q", got, want)
+	}
+
+	execute(t, MigrateCommand(ctx, newWorker), "up", "--yes")
+	out = execute(t, MigrateCommand(ctx, newWorker), "status")
+	if got, want := out, "current version: 2\nlocked version: 1\ndatabase is up to date\n"; got != want {
+		t.Errorf("got=%q, want=%q", got, want)
+	}
+}
+
+func TestMigrateCommandDSN(t *testing.T) {
+	ctx := context.Background()
+	const dsn = "file:clitest?mode=memory&cache=shared"
+
+	// keep the shared in-memory database alive for the test
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.PingContext(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	out := execute(t, MigrateCommandDSN(ctx, "sqlite3", dsn, newTestSchema()), "up")
+	if got, want := out, "migrate up finished version=1"; !strings.Contains(got, want) {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+
+	var count int
+	if err = db.QueryRowContext(ctx, "select count(*) from schema_migrations").Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := count, 1; got != want {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+}
+
+func TestPrompt(t *testing.T) {
+	steps := []*migration.PlannedStep{
+		{ID: 2, Direction: "down"},
+		{ID: 3, Direction: "up"},
+	}
+	tests := []struct {
+		input string
+		want  bool
+	}{
+		{"y\n", true},
+		{"Yes\n", true},
+		{"n\n", false},
+		{"\n", false},
+		{"", false},
+	}
+	for tn, tt := range tests {
+		var buf bytes.Buffer
+		cmd := &cobra.Command{}
+		cmd.SetOutput(&buf)
+		got, err := prompt(cmd, strings.NewReader(tt.input), steps)
+		if err != nil {
+			t.Fatalf("%d: %v", tn, err)
+		}
+		if got != tt.want {
+			t.Errorf("%d: got=%v, want=%v", tn, got, tt.want)
+		}
+		want := "migrate down version=2\nmigrate up version=3\napply 2 migrations? [y/N] "
+		if got := buf.String(); got != want {
+			t.Errorf("%d: got=%q, want=%q", tn, got, want)
+		}
+	}
+}
+
+func execute(t *testing.T, cmd *cobra.Command, args ...string) string {
+	t.Helper()
+	var buf bytes.Buffer
+	cmd.SetOutput(&buf)
+	cmd.SetIn(strings.NewReader(""))
+	cmd.SetArgs(args)
+	if err := cmd.Execute(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+func newTestSchema() *migration.Schema {
+	var schema migration.Schema
+	schema.Define(1).
+		Up(`create table t1(id int primary key);`).
+		Down(`drop table t1;`)
+	return &schema
+}
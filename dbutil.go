@@ -1,20 +1,27 @@
 package migration
 
-import "time"
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
 
 // timeVal implements the sql.Scanner method, and is a forgiving
 // scanner for time values. This is useful when working with sqlite,
 // which stores time values as text or int64. (It also supports
 // float64, but this little type doesn't).
 type timeVal struct {
-	Time time.Time
+	Time  time.Time
+	Valid bool // Valid is false if the value is NULL
 }
 
 func (tv *timeVal) Scan(src interface{}) error {
 	if src == nil {
 		tv.Time = time.Unix(0, 0).UTC()
+		tv.Valid = false
 		return nil
 	}
+	tv.Valid = true
 
 	switch v := src.(type) {
 	case time.Time:
@@ -39,3 +46,33 @@ func (tv *timeVal) Scan(src interface{}) error {
 	tv.Time = time.Unix(0, 0).UTC()
 	return nil
 }
+
+// boolVal scans a boolean column. Databases without a boolean
+// type, such as Oracle, store boolean values as numbers, which
+// some drivers return as strings.
+type boolVal bool
+
+func (bv *boolVal) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case nil:
+		*bv = false
+	case bool:
+		*bv = boolVal(v)
+	case int64:
+		*bv = v != 0
+	case float64:
+		*bv = v != 0
+	case []byte:
+		return bv.Scan(string(v))
+	default:
+		s := fmt.Sprint(v)
+		if b, err := strconv.ParseBool(s); err == nil {
+			*bv = boolVal(b)
+		} else if f, err := strconv.ParseFloat(s, 64); err == nil {
+			*bv = f != 0
+		} else {
+			return fmt.Errorf("cannot scan %T into bool", src)
+		}
+	}
+	return nil
+}
@@ -53,5 +53,42 @@ func TestTimeVal(t *testing.T) {
 		if got, want := tv.Time.Format(time.RFC3339), tt.want; got != want {
 			t.Errorf("%d: got=%v, want=%v", tn, got, want)
 		}
+		if got, want := tv.Valid, tt.src != nil; got != want {
+			t.Errorf("%d: valid: got=%v, want=%v", tn, got, want)
+		}
+	}
+}
+
+// number mimics a driver type for Oracle NUMBER values.
+type number string
+
+func TestBoolVal(t *testing.T) {
+	tests := []struct {
+		src  interface{}
+		want bool
+	}{
+		{src: nil, want: false},
+		{src: true, want: true},
+		{src: int64(0), want: false},
+		{src: int64(1), want: true},
+		{src: float64(1), want: true},
+		{src: []byte("1"), want: true},
+		{src: "0", want: false},
+		{src: number("1"), want: true},
+	}
+	for tn, tt := range tests {
+		var bv boolVal
+		if err := bv.Scan(tt.src); err != nil {
+			t.Errorf("%d: got=%v, want=nil", tn, err)
+			continue
+		}
+		if got, want := bool(bv), tt.want; got != want {
+			t.Errorf("%d: got=%v, want=%v", tn, got, want)
+		}
+	}
+
+	var bv boolVal
+	if err := bv.Scan("INVALID"); err == nil {
+		t.Error("got=nil, want=error")
 	}
 }
@@ -2,8 +2,11 @@ package migration
 
 import (
 	"context"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
 	"fmt"
+	"time"
 )
 
 // A Definition is used to define a database schema version, the action
@@ -11,10 +14,16 @@ import (
 // action required to migrate down to the previous version.
 type Definition struct {
 	id         VersionID
+	name       string
 	upAction   Action
 	upCount    int
 	downAction Action
 	downCount  int
+	enabled    func(context.Context, *sql.DB) (bool, error)
+	meta       map[string]string
+	external   func(context.Context, string) error
+	factory    func() *Definition
+	timeout    time.Duration
 }
 
 func newDefinition(id VersionID) *Definition {
@@ -23,6 +32,13 @@ func newDefinition(id VersionID) *Definition {
 	}
 }
 
+// Name sets an optional human-readable name for the version, which
+// is reported along with the version id.
+func (d *Definition) Name(name string) *Definition {
+	d.name = name
+	return d
+}
+
 // Up defines the SQL to migrate up to the version.
 // Calling this function is identical to calling:
 //  UpAction(Command(sql))
@@ -61,6 +77,73 @@ func (d *Definition) DownAction(a Action) *Definition {
 	return d
 }
 
+// Symmetric defines the SQL to migrate both up to the version and down to
+// the previous version, for migrations that are their own inverse, such as
+// toggling a setting. Calling this method is identical to calling:
+//  Up(sql).Down(sql)
+func (d *Definition) Symmetric(sql string) *Definition {
+	return d.Up(sql).Down(sql)
+}
+
+// SymmetricAction defines the action to perform during the migration both
+// up to this database schema version, and down from it.
+func (d *Definition) SymmetricAction(a Action) *Definition {
+	return d.UpAction(a).DownAction(a)
+}
+
+// ExternalApply specifies a function that applies the SQL for the up and
+// down migrations, in place of the worker executing the SQL directly. This
+// is useful when schema changes are applied using an online schema change
+// tool. The worker still records the version in the migrations table.
+//
+// Migrations applied externally are not performed inside a transaction.
+// ExternalApply has no effect on actions that are not SQL, such as DBFunc.
+func (d *Definition) ExternalApply(fn func(ctx context.Context, sql string) error) *Definition {
+	d.external = fn
+	return d
+}
+
+// Enabled specifies a function that is called when the version is about
+// to be migrated up, and reports whether the migration is enabled. This is
+// useful for gating schema changes behind a feature flag.
+//
+// If the migration is not enabled, its up migration is not performed, but
+// the version is recorded as applied and skipped, so that later versions
+// can be applied. When migrating down, the down migration of a skipped
+// version is not performed.
+//
+// The function is called before the transaction for the up migration
+// begins, so it can query the database, even if the database allows
+// only one open connection.
+func (d *Definition) Enabled(fn func(context.Context, *sql.DB) (bool, error)) *Definition {
+	d.enabled = fn
+	return d
+}
+
+// Timeout limits the time taken to perform the up or down migration
+// for the version. If the migration takes longer, its context is
+// canceled and the migration fails with an error reporting the timeout.
+func (d *Definition) Timeout(timeout time.Duration) *Definition {
+	d.timeout = timeout
+	return d
+}
+
+// SetMeta sets a metadata value for the version, such as a ticket number
+// or an approval id. Metadata is stored in a separate table when the version
+// is migrated up, and can be read using the worker's VersionMeta method.
+//
+// The metadata table is named after the migrations table with the suffix
+// "_metadata", so each migrations table has its own, and has the columns
+// id, name and value. The key is stored in the name column because KEY is
+// a reserved word in MySQL.
+func (d *Definition) SetMeta(key, value string) *Definition {
+	if d.meta == nil {
+		d.meta = make(map[string]string)
+	}
+	d.meta[key] = value
+	return d
+}
+
 func (d *Definition) errs() Errors {
 	var errs Errors
 
@@ -89,10 +172,52 @@ func (d *Definition) errs() Errors {
 }
 
 type action struct {
-	sql      string
-	dbFunc   func(context.Context, *sql.DB) error
-	txFunc   func(context.Context, *sql.Tx) error
-	replayUp *VersionID
+	sql        string
+	dbFunc     func(context.Context, *sql.DB) error
+	txFunc     func(context.Context, *sql.Tx) error
+	batch      *batchAction
+	replayUp   *VersionID
+	replayDown *VersionID
+	external   func(context.Context, string) error
+}
+
+type batchAction struct {
+	query string
+	size  int
+	fn    func(ctx context.Context, tx *sql.Tx, offset int) (affected int, err error)
+}
+
+// isSQL reports whether the action is an SQL/DDL command.
+func (a *action) isSQL() bool {
+	return a.dbFunc == nil && a.txFunc == nil && a.batch == nil
+}
+
+// describe returns the SQL for an SQL action, or a placeholder
+// if the action is implemented in Go.
+func (a *action) describe() string {
+	switch {
+	case a.dbFunc != nil:
+		return "(DBFunc)"
+	case a.txFunc != nil:
+		return "(TxFunc)"
+	case a.batch != nil:
+		return "(BatchUpdate)"
+	}
+	return a.sql
+}
+
+// goChecksum is recorded in place of a checksum for an action
+// implemented in Go, whose changes cannot be detected.
+const goChecksum = "go"
+
+// checksum returns the SHA-256 checksum of the SQL for an SQL action,
+// or goChecksum if the action is implemented in Go.
+func (a *action) checksum() string {
+	if !a.isSQL() {
+		return goChecksum
+	}
+	sum := sha256.Sum256([]byte(a.sql))
+	return hex.EncodeToString(sum[:])
 }
 
 // An Action defines the action performed during an up migration or
@@ -134,6 +259,29 @@ func TxFunc(f func(context.Context, *sql.Tx) error) Action {
 	}
 }
 
+// BatchUpdate returns an action that performs a large data migration in
+// batches, each of which is performed in its own transaction. Batches are
+// performed until a batch affects zero rows. This keeps locks short when
+// backfilling large tables.
+//
+// If fn is nil, each batch executes query with batchSize as its only
+// argument, and the number of rows affected by the query is used.
+// Otherwise fn is called to perform each batch, where offset is the
+// total number of rows affected by previous batches.
+//
+// As with DBFunc, the migration as a whole is not performed inside a
+// transaction, so if a batch fails the database will require manual
+// repair before any more migrations can proceed.
+func BatchUpdate(query string, batchSize int, fn func(ctx context.Context, tx *sql.Tx, offset int) (affected int, err error)) Action {
+	return func(a *action) {
+		a.batch = &batchAction{
+			query: query,
+			size:  batchSize,
+			fn:    fn,
+		}
+	}
+}
+
 // Replay returns an action that replays the up migration for the
 // specified database version. Replay actions are useful for
 // restoring views, functions and stored procedures.
@@ -142,3 +290,12 @@ func Replay(id VersionID) Action {
 		a.replayUp = &id
 	}
 }
+
+// ReplayDown returns an action that replays the down migration for the
+// specified database version. It is the counterpart of Replay, for an up
+// migration that reverses the changes made by an earlier version.
+func ReplayDown(id VersionID) Action {
+	return func(a *action) {
+		a.replayDown = &id
+	}
+}
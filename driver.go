@@ -3,35 +3,168 @@ package migration
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
+	"hash/fnv"
 	"reflect"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 )
 
-// A driver handles database vendor-specific operations.
-type driver interface {
+// A Driver handles database vendor-specific operations.
+//
+// Methods that operate on the migrations table are passed the names of
+// its columns in cols. A nil cols, or a blank field of cols, means the
+// default column name, which is shown in the comment for each field of
+// Columns. Column names are not quoted in SQL statements.
+type Driver interface {
+	// Dialect returns the name of the SQL dialect, such as "postgres",
+	// which is used by NewWorkerWithDialect and DialectDriver.
+	Dialect() string
+
+	// SupportsTransactionalDDL reports whether DDL statements can be
+	// rolled back. If not, SQL migrations are performed outside of a
+	// transaction, and a migration that fails is recorded as failed.
 	SupportsTransactionalDDL() bool
+
+	// PackageNames returns the package names of the database/sql drivers
+	// that the driver handles, which are used by NewWorker.
 	PackageNames() []string
-	CreateMigrationsTable(ctx context.Context, db *sql.DB, tblname string) error
-	InsertVersion(ctx context.Context, tx *sql.Tx, tblname string, ver *Version) error
-	DeleteVersion(ctx context.Context, tx *sql.Tx, tblname string, id VersionID) error
-	ListVersions(ctx context.Context, tx *sql.Tx, tblname string) ([]*Version, error)
-	SetVersionFailed(ctx context.Context, tx *sql.Tx, tblname string, id VersionID, failed bool) error
-	SetVersionLocked(ctx context.Context, tx *sql.Tx, tblname string, id VersionID, locked bool) error
+
+	// CreateMigrationsTable creates the migrations table if it does not
+	// exist, and adds any columns missing from a table created by an
+	// earlier version of the package.
+	CreateMigrationsTable(ctx context.Context, db *sql.DB, tblname string, cols *Columns) error
+
+	// InsertVersion inserts a row for ver into the migrations table.
+	InsertVersion(ctx context.Context, tx *sql.Tx, tblname string, cols *Columns, ver *Version) error
+
+	// DeleteVersion deletes the row for version id, if there is one.
+	DeleteVersion(ctx context.Context, tx *sql.Tx, tblname string, cols *Columns, id VersionID) error
+
+	// ListVersions returns the rows of the migrations table in order
+	// of version id.
+	ListVersions(ctx context.Context, tx *sql.Tx, tblname string, cols *Columns) ([]*Version, error)
+
+	// SetVersionFailed sets the failed column of the row for version id.
+	SetVersionFailed(ctx context.Context, tx *sql.Tx, tblname string, cols *Columns, id VersionID, failed bool) error
+
+	// SetVersionLocked sets the locked column of the row for version id.
+	SetVersionLocked(ctx context.Context, tx *sql.Tx, tblname string, cols *Columns, id VersionID, locked bool) error
+
+	// CreateRunsTable creates the table of completed run ids used by
+	// Worker.RunID, if it does not exist.
+	CreateRunsTable(ctx context.Context, db *sql.DB, tblname string) error
+
+	// RunCompleted reports whether the runs table has a row for runID.
+	RunCompleted(ctx context.Context, tx *sql.Tx, tblname string, runID string) (bool, error)
+
+	// InsertRun inserts a row for runID into the runs table.
+	InsertRun(ctx context.Context, tx *sql.Tx, tblname string, runID string, completedAt time.Time) error
+
+	// CreateSeedsTable creates the table of performed seeds, if it does
+	// not exist.
+	CreateSeedsTable(ctx context.Context, db *sql.DB, tblname string) error
+
+	// SeedApplied reports whether the seeds table has a row for name.
+	SeedApplied(ctx context.Context, tx *sql.Tx, tblname string, name string) (bool, error)
+
+	// InsertSeed inserts a row for name into the seeds table.
+	InsertSeed(ctx context.Context, tx *sql.Tx, tblname string, name string, appliedAt time.Time) error
+
+	// LockTimeoutSQL returns the statement that limits the time that a
+	// session waits for locks to timeout, and the statement that restores
+	// the default. Both are blank if the database has no lock timeout.
+	// The timeout is positive, and is rounded up to the unit used by the
+	// database, so that it is never zero.
+	LockTimeoutSQL(timeout time.Duration) (set string, reset string)
+
+	// AdvisoryLock waits for the advisory lock identified by key, and
+	// returns the connection that holds it. The connection is passed to
+	// AdvisoryUnlock, and is not used for anything else, so the database
+	// must allow another open connection for the migrations. A nil
+	// connection, with a nil error, means that the database has no
+	// advisory locks and nothing is held.
+	AdvisoryLock(ctx context.Context, db *sql.DB, key string) (*sql.Conn, error)
+
+	// AdvisoryUnlock releases the advisory lock held by conn, which was
+	// returned by AdvisoryLock, and closes conn. It does nothing if conn
+	// is nil.
+	AdvisoryUnlock(ctx context.Context, conn *sql.Conn, key string) error
+
+	// CreateMetadataTable creates the table of version metadata, if it
+	// does not exist.
+	CreateMetadataTable(ctx context.Context, db *sql.DB, tblname string) error
+
+	// InsertMetadata inserts a row for each key of meta for version id.
+	InsertMetadata(ctx context.Context, tx *sql.Tx, tblname string, id VersionID, meta map[string]string) error
+
+	// DeleteMetadata deletes the metadata rows for version id, if any.
+	DeleteMetadata(ctx context.Context, tx *sql.Tx, tblname string, id VersionID) error
+
+	// ListMetadata returns the metadata for version id, which is empty
+	// if there are no rows.
+	ListMetadata(ctx context.Context, tx *sql.Tx, tblname string, id VersionID) (map[string]string, error)
+
+	// DumpSchemaDDL returns the statements that create the tables,
+	// indexes and views in the database, excluding the migrations
+	// tables that have the default names.
+	DumpSchemaDDL(ctx context.Context, db *sql.DB) ([]string, error)
+
+	// IsRetryable reports whether err is a transient error, such as
+	// a serialization failure or deadlock. A migration transaction that
+	// fails with a retryable error is attempted again, up to a limited
+	// number of times. Return false if the database reports no such errors.
+	IsRetryable(err error) bool
 }
 
-var drivers = []driver{
-	&postgres{},
-	&sqlite{},
-	&mysql{},
+var (
+	driversMu sync.RWMutex
+	drivers   = []Driver{
+		&postgres{},
+		&sqlite{},
+		&mysql{},
+		&sqlserver{},
+		&cockroach{},
+		&oracle{},
+	}
+)
+
+// RegisterDriver registers a migration driver for a database that is not
+// supported by the built-in drivers, such as IBM Db2. Workers created
+// using NewWorker use the registered driver when the package name of the
+// database/sql driver matches one of its PackageNames.
+//
+// RegisterDriver panics if d is nil, or if any of its package names is
+// already handled by another driver.
+func RegisterDriver(d Driver) {
+	if d == nil {
+		panic("migration: RegisterDriver driver is nil")
+	}
+	driversMu.Lock()
+	defer driversMu.Unlock()
+	for _, drv := range drivers {
+		for _, p := range drv.PackageNames() {
+			for _, np := range d.PackageNames() {
+				if p == np {
+					panic(fmt.Sprintf("migration: RegisterDriver called twice for package %s", p))
+				}
+			}
+		}
+	}
+	drivers = append(drivers, d)
 }
 
-func findDriver(db *sql.DB) (driver, error) {
+func findDriver(db *sql.DB) (Driver, error) {
 	driverType := reflect.TypeOf(db.Driver()).String()
 	driverType = strings.TrimLeft(driverType, "*")
 	split := strings.SplitN(driverType, ".", 2)
 	pkgname := split[0]
 
+	driversMu.RLock()
+	defer driversMu.RUnlock()
 	for _, drv := range drivers {
 		for _, p := range drv.PackageNames() {
 			if p == pkgname {
@@ -43,48 +176,206 @@ func findDriver(db *sql.DB) (driver, error) {
 	return nil, fmt.Errorf("cannot find migration driver for %s", pkgname)
 }
 
+func findDialect(dialect string) (Driver, error) {
+	driversMu.RLock()
+	defer driversMu.RUnlock()
+	for _, drv := range drivers {
+		if drv.Dialect() == dialect {
+			return drv, nil
+		}
+	}
+
+	return nil, fmt.Errorf("unknown migration dialect %s", dialect)
+}
+
+var (
+	namedDriversMu sync.RWMutex
+	namedDrivers   = map[string]Driver{
+		"postgres":  &postgres{},
+		"sqlite3":   &sqlite{},
+		"mysql":     &mysql{},
+		"mssql":     &sqlserver{},
+		"sqlserver": &sqlserver{},
+		"godror":    &oracle{},
+		"oracle":    &oracle{},
+	}
+)
+
+// DialectDriver returns the migration driver for the SQL dialect,
+// which is one of "postgres", "sqlite", "mysql", "sqlserver", "cockroach"
+// or "oracle".
+func DialectDriver(dialect string) (Driver, error) {
+	return findDialect(dialect)
+}
+
+// RegisterDriverForName registers the migration driver to use for
+// database connections opened using the database/sql driver name,
+// for example "pgx". Workers created using NewWorkerNamed use
+// the registered driver. If RegisterDriverForName is called twice
+// with the same name, the second driver replaces the first.
+//
+// The driver for a built-in dialect is obtained by calling DialectDriver.
+func RegisterDriverForName(sqlDriverName string, d Driver) {
+	if d == nil {
+		panic("migration: RegisterDriverForName driver is nil")
+	}
+	namedDriversMu.Lock()
+	defer namedDriversMu.Unlock()
+	namedDrivers[sqlDriverName] = d
+}
+
+func findNamedDriver(sqlDriverName string) (Driver, error) {
+	namedDriversMu.RLock()
+	defer namedDriversMu.RUnlock()
+	if drv, ok := namedDrivers[sqlDriverName]; ok {
+		return drv, nil
+	}
+	return nil, fmt.Errorf("no migration driver registered for %s", sqlDriverName)
+}
+
 type postgres struct{}
 
+func (w *postgres) Dialect() string {
+	return "postgres"
+}
+
 func (w *postgres) PackageNames() []string {
 	return []string{"pq"}
 }
 
+func (w *postgres) IsRetryable(err error) bool {
+	return false
+}
+
 func (w *postgres) SupportsTransactionalDDL() bool {
 	return true
 }
 
-func (w *postgres) CreateMigrationsTable(ctx context.Context, db *sql.DB, tblname string) error {
+func (w *postgres) LockTimeoutSQL(timeout time.Duration) (string, string) {
+	// lock_timeout is in milliseconds, and zero disables the timeout
+	ms := int64((timeout + time.Millisecond - 1) / time.Millisecond)
+	set := fmt.Sprintf("set lock_timeout = %d", ms)
+	return set, "reset lock_timeout"
+}
+
+func (w *postgres) AdvisoryLock(ctx context.Context, db *sql.DB, key string) (*sql.Conn, error) {
+	return commonAdvisoryLock(ctx, db, `select pg_advisory_lock($1)`, advisoryLockID(key))
+}
+
+func (w *postgres) AdvisoryUnlock(ctx context.Context, conn *sql.Conn, key string) error {
+	return commonAdvisoryUnlock(ctx, conn, `select pg_advisory_unlock($1)`, advisoryLockID(key))
+}
+
+func (w *postgres) CreateMigrationsTable(ctx context.Context, db *sql.DB, tblname string, cols *Columns) error {
+	format := `create table if not exists %s` +
+		`({id} bigint primary key` +
+		`,{applied_at} timestamptz not null` +
+		`,{failed} boolean not null default 'false'` +
+		`,{locked} boolean not null default 'false'` +
+		`,{environment} text` +
+		`,{skipped} boolean not null default 'false'` +
+		`,{checksum} varchar(64)` +
+		`,{duration_ms} bigint not null default 0` +
+		`,{applied_by} text` +
+		`);`
+	if err := commonCreateMigrationsTable(ctx, db, tblname, cols.expand(format)); err != nil {
+		return err
+	}
+	return commonAddColumns(ctx, db, tblname, cols,
+		"{environment} text",
+		"{skipped} boolean not null default 'false'",
+		"{checksum} varchar(64)",
+		"{duration_ms} bigint not null default 0",
+		"{applied_by} text",
+	)
+}
+
+func (w *postgres) InsertVersion(ctx context.Context, tx *sql.Tx, tblname string, cols *Columns, ver *Version) error {
+	format := `insert into %s({id},{applied_at},{failed},{locked},{environment},{skipped},{checksum},{duration_ms},{applied_by}) values($1,$2,$3,$4,$5,$6,$7,$8,$9);`
+	return commonInsertVersion(ctx, tx, tblname, cols, ver, format)
+}
+
+func (w *postgres) DeleteVersion(ctx context.Context, tx *sql.Tx, tblname string, cols *Columns, id VersionID) error {
+	format := `delete from %s where {id} = $1;`
+	return commonDeleteVersion(ctx, tx, tblname, cols, id, format)
+}
+
+func (w *postgres) ListVersions(ctx context.Context, tx *sql.Tx, tblname string, cols *Columns) ([]*Version, error) {
+	return commonListVersions(ctx, tx, tblname, cols)
+}
+
+func (w *postgres) SetVersionFailed(ctx context.Context, tx *sql.Tx, tblname string, cols *Columns, id VersionID, failed bool) error {
+	format := `update %s set {failed} = $1 where {id} = $2`
+	return commonSetBool(ctx, tx, tblname, cols, id, failed, format)
+}
+
+func (w *postgres) SetVersionLocked(ctx context.Context, tx *sql.Tx, tblname string, cols *Columns, id VersionID, locked bool) error {
+	format := `update %s set {locked} = $1 where {id} = $2`
+	return commonSetBool(ctx, tx, tblname, cols, id, locked, format)
+}
+
+func (w *postgres) CreateRunsTable(ctx context.Context, db *sql.DB, tblname string) error {
 	format := `create table if not exists %s` +
-		`(id bigint primary key` +
+		`(run_id text primary key` +
+		`,completed_at timestamptz not null` +
+		`);`
+	return commonCreateMigrationsTable(ctx, db, tblname, format)
+}
+
+func (w *postgres) RunCompleted(ctx context.Context, tx *sql.Tx, tblname string, runID string) (bool, error) {
+	format := `select count(*) from %s where run_id = $1`
+	return commonRunCompleted(ctx, tx, tblname, runID, format)
+}
+
+func (w *postgres) InsertRun(ctx context.Context, tx *sql.Tx, tblname string, runID string, completedAt time.Time) error {
+	format := `insert into %s(run_id,completed_at) values($1,$2);`
+	return commonInsertRun(ctx, tx, tblname, runID, completedAt, format)
+}
+
+func (w *postgres) CreateSeedsTable(ctx context.Context, db *sql.DB, tblname string) error {
+	format := `create table if not exists %s` +
+		`(name text primary key` +
 		`,applied_at timestamptz not null` +
-		`,failed boolean not null default 'false'` +
-		`,locked boolean not null default 'false'` +
 		`);`
 	return commonCreateMigrationsTable(ctx, db, tblname, format)
 }
 
-func (w *postgres) InsertVersion(ctx context.Context, tx *sql.Tx, tblname string, ver *Version) error {
-	format := `insert into %s(id,applied_at,failed,locked) values($1,$2,$3,$4);`
-	return commonInsertVersion(ctx, tx, tblname, ver, format)
+func (w *postgres) SeedApplied(ctx context.Context, tx *sql.Tx, tblname string, name string) (bool, error) {
+	format := `select count(*) from %s where name = $1`
+	return commonSeedApplied(ctx, tx, tblname, name, format)
 }
 
-func (w *postgres) DeleteVersion(ctx context.Context, tx *sql.Tx, tblname string, id VersionID) error {
-	format := `delete from %s where id = $1;`
-	return commonDeleteVersion(ctx, tx, tblname, id, format)
+func (w *postgres) InsertSeed(ctx context.Context, tx *sql.Tx, tblname string, name string, appliedAt time.Time) error {
+	format := `insert into %s(name,applied_at) values($1,$2);`
+	return commonInsertSeed(ctx, tx, tblname, name, appliedAt, format)
 }
 
-func (w *postgres) ListVersions(ctx context.Context, tx *sql.Tx, tblname string) ([]*Version, error) {
-	return commonListVersions(ctx, tx, tblname)
+func (w *postgres) CreateMetadataTable(ctx context.Context, db *sql.DB, tblname string) error {
+	format := `create table if not exists %s` +
+		`(id bigint not null` +
+		`,name text not null` +
+		`,value text not null` +
+		`,primary key(id,name)` +
+		`);`
+	return commonCreateMigrationsTable(ctx, db, tblname, format)
 }
 
-func (w *postgres) SetVersionFailed(ctx context.Context, tx *sql.Tx, tblname string, id VersionID, failed bool) error {
-	format := `update %s set failed = $1 where id = $2`
-	return commonSetBool(ctx, tx, tblname, id, failed, format)
+func (w *postgres) InsertMetadata(ctx context.Context, tx *sql.Tx, tblname string, id VersionID, meta map[string]string) error {
+	if err := w.DeleteMetadata(ctx, tx, tblname, id); err != nil {
+		return err
+	}
+	format := `insert into %s(id,name,value) values($1,$2,$3);`
+	return commonInsertMetadata(ctx, tx, tblname, id, meta, format)
 }
 
-func (w *postgres) SetVersionLocked(ctx context.Context, tx *sql.Tx, tblname string, id VersionID, locked bool) error {
-	format := `update %s set locked = $1 where id = $2`
-	return commonSetBool(ctx, tx, tblname, id, locked, format)
+func (w *postgres) DeleteMetadata(ctx context.Context, tx *sql.Tx, tblname string, id VersionID) error {
+	format := `delete from %s where id = $1`
+	return commonDeleteMetadata(ctx, tx, tblname, id, format)
+}
+
+func (w *postgres) ListMetadata(ctx context.Context, tx *sql.Tx, tblname string, id VersionID) (map[string]string, error) {
+	format := `select name,value from %s where id = $1`
+	return commonListMetadata(ctx, tx, tblname, id, format)
 }
 
 func wrapf(err error, format string, args ...interface{}) error {
@@ -111,112 +402,603 @@ func (e wrappedError) Cause() error {
 
 type sqlite struct{}
 
+func (w *sqlite) Dialect() string {
+	return "sqlite"
+}
+
 func (w *sqlite) PackageNames() []string {
 	return []string{"sqlite3"}
 }
 
+func (w *sqlite) IsRetryable(err error) bool {
+	return false
+}
+
 func (w *sqlite) SupportsTransactionalDDL() bool {
 	return true
 }
 
-func (w *sqlite) CreateMigrationsTable(ctx context.Context, db *sql.DB, tblname string) error {
+func (w *sqlite) LockTimeoutSQL(timeout time.Duration) (string, string) {
+	return "", ""
+}
+
+func (w *sqlite) AdvisoryLock(ctx context.Context, db *sql.DB, key string) (*sql.Conn, error) {
+	// SQLite has no advisory locks, and an in-memory database cannot
+	// spare a connection, so wait for database locks instead
+	if _, err := db.ExecContext(ctx, `pragma busy_timeout = 5000`); err != nil {
+		return nil, wrapf(err, "cannot set busy timeout")
+	}
+	return nil, nil
+}
+
+func (w *sqlite) AdvisoryUnlock(ctx context.Context, conn *sql.Conn, key string) error {
+	return nil
+}
+
+func (w *sqlite) CreateMigrationsTable(ctx context.Context, db *sql.DB, tblname string, cols *Columns) error {
+	format := `create table if not exists %s` +
+		`({id} integer primary key` +
+		`,{applied_at} text not null` +
+		`,{failed} integer not null` +
+		`,{locked} integer not null` +
+		`,{environment} text` +
+		`,{skipped} integer not null default 0` +
+		`,{checksum} varchar(64)` +
+		`,{duration_ms} integer not null default 0` +
+		`,{applied_by} text` +
+		`);`
+	if err := commonCreateMigrationsTable(ctx, db, tblname, cols.expand(format)); err != nil {
+		return err
+	}
+	return commonAddColumns(ctx, db, tblname, cols,
+		"{environment} text",
+		"{skipped} integer not null default 0",
+		"{checksum} varchar(64)",
+		"{duration_ms} integer not null default 0",
+		"{applied_by} text",
+	)
+}
+
+func (w *sqlite) InsertVersion(ctx context.Context, tx *sql.Tx, tblname string, cols *Columns, ver *Version) error {
+	format := `insert into %s({id},{applied_at},{failed},{locked},{environment},{skipped},{checksum},{duration_ms},{applied_by}) values(?,?,?,?,?,?,?,?,?);`
+	return commonInsertVersion(ctx, tx, tblname, cols, ver, format)
+}
+
+func (w *sqlite) DeleteVersion(ctx context.Context, tx *sql.Tx, tblname string, cols *Columns, id VersionID) error {
+	format := `delete from %s where {id} = ?;`
+	return commonDeleteVersion(ctx, tx, tblname, cols, id, format)
+}
+
+func (w *sqlite) ListVersions(ctx context.Context, tx *sql.Tx, tblname string, cols *Columns) ([]*Version, error) {
+	return commonListVersions(ctx, tx, tblname, cols)
+}
+
+func (w *sqlite) SetVersionFailed(ctx context.Context, tx *sql.Tx, tblname string, cols *Columns, id VersionID, failed bool) error {
+	format := `update %s set {failed} = ? where {id} = ?`
+	return commonSetBool(ctx, tx, tblname, cols, id, failed, format)
+}
+
+func (w *sqlite) SetVersionLocked(ctx context.Context, tx *sql.Tx, tblname string, cols *Columns, id VersionID, locked bool) error {
+	format := `update %s set {locked} = ? where {id} = ?`
+	return commonSetBool(ctx, tx, tblname, cols, id, locked, format)
+}
+
+func (w *sqlite) CreateRunsTable(ctx context.Context, db *sql.DB, tblname string) error {
+	format := `create table if not exists %s` +
+		`(run_id text primary key` +
+		`,completed_at text not null` +
+		`);`
+	return commonCreateMigrationsTable(ctx, db, tblname, format)
+}
+
+func (w *sqlite) RunCompleted(ctx context.Context, tx *sql.Tx, tblname string, runID string) (bool, error) {
+	format := `select count(*) from %s where run_id = ?`
+	return commonRunCompleted(ctx, tx, tblname, runID, format)
+}
+
+func (w *sqlite) InsertRun(ctx context.Context, tx *sql.Tx, tblname string, runID string, completedAt time.Time) error {
+	format := `insert into %s(run_id,completed_at) values(?,?);`
+	return commonInsertRun(ctx, tx, tblname, runID, completedAt, format)
+}
+
+func (w *sqlite) CreateSeedsTable(ctx context.Context, db *sql.DB, tblname string) error {
 	format := `create table if not exists %s` +
-		`(id integer primary key` +
+		`(name text primary key` +
 		`,applied_at text not null` +
-		`,failed integer not null` +
-		`,locked integer not null` +
 		`);`
 	return commonCreateMigrationsTable(ctx, db, tblname, format)
 }
 
-func (w *sqlite) InsertVersion(ctx context.Context, tx *sql.Tx, tblname string, ver *Version) error {
-	format := `insert into %s(id,applied_at,failed,locked) values(?,?,?,?);`
-	return commonInsertVersion(ctx, tx, tblname, ver, format)
+func (w *sqlite) SeedApplied(ctx context.Context, tx *sql.Tx, tblname string, name string) (bool, error) {
+	format := `select count(*) from %s where name = ?`
+	return commonSeedApplied(ctx, tx, tblname, name, format)
 }
 
-func (w *sqlite) DeleteVersion(ctx context.Context, tx *sql.Tx, tblname string, id VersionID) error {
-	format := `delete from %s where id = ?;`
-	return commonDeleteVersion(ctx, tx, tblname, id, format)
+func (w *sqlite) InsertSeed(ctx context.Context, tx *sql.Tx, tblname string, name string, appliedAt time.Time) error {
+	format := `insert into %s(name,applied_at) values(?,?);`
+	return commonInsertSeed(ctx, tx, tblname, name, appliedAt, format)
 }
 
-func (w *sqlite) ListVersions(ctx context.Context, tx *sql.Tx, tblname string) ([]*Version, error) {
-	return commonListVersions(ctx, tx, tblname)
+func (w *sqlite) CreateMetadataTable(ctx context.Context, db *sql.DB, tblname string) error {
+	format := `create table if not exists %s` +
+		`(id integer not null` +
+		`,name text not null` +
+		`,value text not null` +
+		`,primary key(id,name)` +
+		`);`
+	return commonCreateMigrationsTable(ctx, db, tblname, format)
 }
 
-func (w *sqlite) SetVersionFailed(ctx context.Context, tx *sql.Tx, tblname string, id VersionID, failed bool) error {
-	format := `update %s set failed = ? where id = ?`
-	return commonSetBool(ctx, tx, tblname, id, failed, format)
+func (w *sqlite) InsertMetadata(ctx context.Context, tx *sql.Tx, tblname string, id VersionID, meta map[string]string) error {
+	if err := w.DeleteMetadata(ctx, tx, tblname, id); err != nil {
+		return err
+	}
+	format := `insert into %s(id,name,value) values(?,?,?);`
+	return commonInsertMetadata(ctx, tx, tblname, id, meta, format)
 }
 
-func (w *sqlite) SetVersionLocked(ctx context.Context, tx *sql.Tx, tblname string, id VersionID, locked bool) error {
-	format := `update %s set locked = ? where id = ?`
-	return commonSetBool(ctx, tx, tblname, id, locked, format)
+func (w *sqlite) DeleteMetadata(ctx context.Context, tx *sql.Tx, tblname string, id VersionID) error {
+	format := `delete from %s where id = ?`
+	return commonDeleteMetadata(ctx, tx, tblname, id, format)
+}
+
+func (w *sqlite) ListMetadata(ctx context.Context, tx *sql.Tx, tblname string, id VersionID) (map[string]string, error) {
+	format := `select name,value from %s where id = ?`
+	return commonListMetadata(ctx, tx, tblname, id, format)
 }
 
 type mysql struct{}
 
+func (w *mysql) Dialect() string {
+	return "mysql"
+}
+
 func (w *mysql) PackageNames() []string {
 	return []string{"mysql"}
 }
 
+func (w *mysql) IsRetryable(err error) bool {
+	return false
+}
+
 func (w *mysql) SupportsTransactionalDDL() bool {
 	return false
 }
 
-func (w *mysql) CreateMigrationsTable(ctx context.Context, db *sql.DB, tblname string) error {
+func (w *mysql) LockTimeoutSQL(timeout time.Duration) (string, string) {
+	// innodb_lock_wait_timeout is in whole seconds, with a minimum of 1
+	seconds := int64((timeout + time.Second - 1) / time.Second)
+	set := fmt.Sprintf("set session innodb_lock_wait_timeout = %d", seconds)
+	return set, "set session innodb_lock_wait_timeout = default"
+}
+
+func (w *mysql) AdvisoryLock(ctx context.Context, db *sql.DB, key string) (*sql.Conn, error) {
+	name := fmt.Sprintf("migration:%x", advisoryLockID(key))
+	return commonAdvisoryLock(ctx, db, `select get_lock(?, -1)`, name)
+}
+
+func (w *mysql) AdvisoryUnlock(ctx context.Context, conn *sql.Conn, key string) error {
+	name := fmt.Sprintf("migration:%x", advisoryLockID(key))
+	return commonAdvisoryUnlock(ctx, conn, `select release_lock(?)`, name)
+}
+
+func (w *mysql) CreateMigrationsTable(ctx context.Context, db *sql.DB, tblname string, cols *Columns) error {
 	format := `create table if not exists %s` +
-		`(id integer primary key` +
+		`({id} integer primary key` +
+		`,{applied_at} datetime not null` +
+		`,{failed} integer not null` +
+		`,{locked} integer not null` +
+		`,{environment} varchar(255)` +
+		`,{skipped} integer not null default 0` +
+		`,{checksum} varchar(64)` +
+		`,{duration_ms} bigint not null default 0` +
+		`,{applied_by} varchar(255)` +
+		`);`
+	if err := commonCreateMigrationsTable(ctx, db, tblname, cols.expand(format)); err != nil {
+		return err
+	}
+	return commonAddColumns(ctx, db, tblname, cols,
+		"{environment} varchar(255)",
+		"{skipped} integer not null default 0",
+		"{checksum} varchar(64)",
+		"{duration_ms} bigint not null default 0",
+		"{applied_by} varchar(255)",
+	)
+}
+
+func (w *mysql) InsertVersion(ctx context.Context, tx *sql.Tx, tblname string, cols *Columns, ver *Version) error {
+	format := `insert into %s({id},{applied_at},{failed},{locked},{environment},{skipped},{checksum},{duration_ms},{applied_by}) values(?,?,?,?,?,?,?,?,?);`
+	return commonInsertVersion(ctx, tx, tblname, cols, ver, format)
+}
+
+func (w *mysql) DeleteVersion(ctx context.Context, tx *sql.Tx, tblname string, cols *Columns, id VersionID) error {
+	format := `delete from %s where {id} = ?;`
+	return commonDeleteVersion(ctx, tx, tblname, cols, id, format)
+}
+
+func (w *mysql) ListVersions(ctx context.Context, tx *sql.Tx, tblname string, cols *Columns) ([]*Version, error) {
+	return commonListVersions(ctx, tx, tblname, cols)
+}
+
+func (w *mysql) SetVersionFailed(ctx context.Context, tx *sql.Tx, tblname string, cols *Columns, id VersionID, failed bool) error {
+	format := `update %s set {failed} = ? where {id} = ?`
+	return commonSetBool(ctx, tx, tblname, cols, id, failed, format)
+}
+
+func (w *mysql) SetVersionLocked(ctx context.Context, tx *sql.Tx, tblname string, cols *Columns, id VersionID, locked bool) error {
+	format := `update %s set {locked} = ? where {id} = ?`
+	return commonSetBool(ctx, tx, tblname, cols, id, locked, format)
+}
+
+func (w *mysql) CreateRunsTable(ctx context.Context, db *sql.DB, tblname string) error {
+	format := `create table if not exists %s` +
+		`(run_id varchar(255) primary key` +
+		`,completed_at datetime not null` +
+		`);`
+	return commonCreateMigrationsTable(ctx, db, tblname, format)
+}
+
+func (w *mysql) RunCompleted(ctx context.Context, tx *sql.Tx, tblname string, runID string) (bool, error) {
+	format := `select count(*) from %s where run_id = ?`
+	return commonRunCompleted(ctx, tx, tblname, runID, format)
+}
+
+func (w *mysql) InsertRun(ctx context.Context, tx *sql.Tx, tblname string, runID string, completedAt time.Time) error {
+	format := `insert into %s(run_id,completed_at) values(?,?);`
+	return commonInsertRun(ctx, tx, tblname, runID, completedAt, format)
+}
+
+func (w *mysql) CreateSeedsTable(ctx context.Context, db *sql.DB, tblname string) error {
+	format := `create table if not exists %s` +
+		`(name varchar(255) primary key` +
 		`,applied_at datetime not null` +
-		`,failed integer not null` +
-		`,locked integer not null` +
 		`);`
 	return commonCreateMigrationsTable(ctx, db, tblname, format)
 }
 
-func (w *mysql) InsertVersion(ctx context.Context, tx *sql.Tx, tblname string, ver *Version) error {
-	format := `insert into %s(id,applied_at,failed,locked) values(?,?,?,?);`
-	return commonInsertVersion(ctx, tx, tblname, ver, format)
+func (w *mysql) SeedApplied(ctx context.Context, tx *sql.Tx, tblname string, name string) (bool, error) {
+	format := `select count(*) from %s where name = ?`
+	return commonSeedApplied(ctx, tx, tblname, name, format)
+}
+
+func (w *mysql) InsertSeed(ctx context.Context, tx *sql.Tx, tblname string, name string, appliedAt time.Time) error {
+	format := `insert into %s(name,applied_at) values(?,?);`
+	return commonInsertSeed(ctx, tx, tblname, name, appliedAt, format)
+}
+
+func (w *mysql) CreateMetadataTable(ctx context.Context, db *sql.DB, tblname string) error {
+	format := `create table if not exists %s` +
+		`(id integer not null` +
+		`,name varchar(255) not null` +
+		`,value text not null` +
+		`,primary key(id,name)` +
+		`);`
+	return commonCreateMigrationsTable(ctx, db, tblname, format)
+}
+
+func (w *mysql) InsertMetadata(ctx context.Context, tx *sql.Tx, tblname string, id VersionID, meta map[string]string) error {
+	if err := w.DeleteMetadata(ctx, tx, tblname, id); err != nil {
+		return err
+	}
+	format := `insert into %s(id,name,value) values(?,?,?);`
+	return commonInsertMetadata(ctx, tx, tblname, id, meta, format)
+}
+
+func (w *mysql) DeleteMetadata(ctx context.Context, tx *sql.Tx, tblname string, id VersionID) error {
+	format := `delete from %s where id = ?`
+	return commonDeleteMetadata(ctx, tx, tblname, id, format)
+}
+
+func (w *mysql) ListMetadata(ctx context.Context, tx *sql.Tx, tblname string, id VersionID) (map[string]string, error) {
+	format := `select name,value from %s where id = ?`
+	return commonListMetadata(ctx, tx, tblname, id, format)
+}
+
+type sqlserver struct{}
+
+func (w *sqlserver) Dialect() string {
+	return "sqlserver"
+}
+
+func (w *sqlserver) PackageNames() []string {
+	return []string{"mssql", "sqlserver"}
+}
+
+func (w *sqlserver) IsRetryable(err error) bool {
+	return false
+}
+
+func (w *sqlserver) SupportsTransactionalDDL() bool {
+	return true
+}
+
+func (w *sqlserver) LockTimeoutSQL(timeout time.Duration) (string, string) {
+	// lock_timeout is in milliseconds, and zero means no waiting at all
+	ms := int64((timeout + time.Millisecond - 1) / time.Millisecond)
+	set := fmt.Sprintf("set lock_timeout %d", ms)
+	return set, "set lock_timeout -1"
+}
+
+func (w *sqlserver) AdvisoryLock(ctx context.Context, db *sql.DB, key string) (*sql.Conn, error) {
+	query := `exec sp_getapplock @Resource = @p1, @LockMode = 'Exclusive', @LockOwner = 'Session', @LockTimeout = -1`
+	return commonAdvisoryLock(ctx, db, query, "migration:"+key)
+}
+
+func (w *sqlserver) AdvisoryUnlock(ctx context.Context, conn *sql.Conn, key string) error {
+	query := `exec sp_releaseapplock @Resource = @p1, @LockOwner = 'Session'`
+	return commonAdvisoryUnlock(ctx, conn, query, "migration:"+key)
+}
+
+// SQL Server does not support "create table if not exists", so the
+// create table statements check for the table in the system catalog.
+
+func (w *sqlserver) CreateMigrationsTable(ctx context.Context, db *sql.DB, tblname string, cols *Columns) error {
+	format := `if object_id('%[1]s', 'U') is null create table %[1]s` +
+		`({id} bigint primary key` +
+		`,{applied_at} datetime2 not null` +
+		`,{failed} bit not null` +
+		`,{locked} bit not null` +
+		`,{environment} nvarchar(255)` +
+		`,{skipped} bit not null default 0` +
+		`,{checksum} nvarchar(64)` +
+		`,{duration_ms} bigint not null default 0` +
+		`,{applied_by} nvarchar(255)` +
+		`);`
+	if err := commonCreateMigrationsTable(ctx, db, tblname, cols.expand(format)); err != nil {
+		return err
+	}
+	// SQL Server does not accept the "column" keyword when adding a column
+	return addColumns(ctx, db, tblname, cols, "alter table %s add %s",
+		"{duration_ms} bigint not null default 0",
+		"{applied_by} nvarchar(255)",
+	)
+}
+
+func (w *sqlserver) InsertVersion(ctx context.Context, tx *sql.Tx, tblname string, cols *Columns, ver *Version) error {
+	format := `insert into %s({id},{applied_at},{failed},{locked},{environment},{skipped},{checksum},{duration_ms},{applied_by}) values(@p1,@p2,@p3,@p4,@p5,@p6,@p7,@p8,@p9);`
+	return commonInsertVersion(ctx, tx, tblname, cols, ver, format)
+}
+
+func (w *sqlserver) DeleteVersion(ctx context.Context, tx *sql.Tx, tblname string, cols *Columns, id VersionID) error {
+	format := `delete from %s where {id} = @p1;`
+	return commonDeleteVersion(ctx, tx, tblname, cols, id, format)
+}
+
+func (w *sqlserver) ListVersions(ctx context.Context, tx *sql.Tx, tblname string, cols *Columns) ([]*Version, error) {
+	// bit columns scan as bool, and order by is permitted because
+	// the query is not a view or subquery
+	return commonListVersions(ctx, tx, tblname, cols)
+}
+
+func (w *sqlserver) SetVersionFailed(ctx context.Context, tx *sql.Tx, tblname string, cols *Columns, id VersionID, failed bool) error {
+	format := `update %s set {failed} = @p1 where {id} = @p2`
+	return commonSetBool(ctx, tx, tblname, cols, id, failed, format)
+}
+
+func (w *sqlserver) SetVersionLocked(ctx context.Context, tx *sql.Tx, tblname string, cols *Columns, id VersionID, locked bool) error {
+	format := `update %s set {locked} = @p1 where {id} = @p2`
+	return commonSetBool(ctx, tx, tblname, cols, id, locked, format)
+}
+
+func (w *sqlserver) CreateRunsTable(ctx context.Context, db *sql.DB, tblname string) error {
+	format := `if object_id('%[1]s', 'U') is null create table %[1]s` +
+		`(run_id nvarchar(255) primary key` +
+		`,completed_at datetime2 not null` +
+		`);`
+	return commonCreateMigrationsTable(ctx, db, tblname, format)
+}
+
+func (w *sqlserver) RunCompleted(ctx context.Context, tx *sql.Tx, tblname string, runID string) (bool, error) {
+	format := `select count(*) from %s where run_id = @p1`
+	return commonRunCompleted(ctx, tx, tblname, runID, format)
+}
+
+func (w *sqlserver) InsertRun(ctx context.Context, tx *sql.Tx, tblname string, runID string, completedAt time.Time) error {
+	format := `insert into %s(run_id,completed_at) values(@p1,@p2);`
+	return commonInsertRun(ctx, tx, tblname, runID, completedAt, format)
+}
+
+func (w *sqlserver) CreateSeedsTable(ctx context.Context, db *sql.DB, tblname string) error {
+	format := `if object_id('%[1]s', 'U') is null create table %[1]s` +
+		`(name nvarchar(255) primary key` +
+		`,applied_at datetime2 not null` +
+		`);`
+	return commonCreateMigrationsTable(ctx, db, tblname, format)
+}
+
+func (w *sqlserver) SeedApplied(ctx context.Context, tx *sql.Tx, tblname string, name string) (bool, error) {
+	format := `select count(*) from %s where name = @p1`
+	return commonSeedApplied(ctx, tx, tblname, name, format)
+}
+
+func (w *sqlserver) InsertSeed(ctx context.Context, tx *sql.Tx, tblname string, name string, appliedAt time.Time) error {
+	format := `insert into %s(name,applied_at) values(@p1,@p2);`
+	return commonInsertSeed(ctx, tx, tblname, name, appliedAt, format)
+}
+
+func (w *sqlserver) CreateMetadataTable(ctx context.Context, db *sql.DB, tblname string) error {
+	format := `if object_id('%[1]s', 'U') is null create table %[1]s` +
+		`(id bigint not null` +
+		`,name nvarchar(255) not null` +
+		`,value nvarchar(max) not null` +
+		`,primary key(id,name)` +
+		`);`
+	return commonCreateMigrationsTable(ctx, db, tblname, format)
+}
+
+func (w *sqlserver) InsertMetadata(ctx context.Context, tx *sql.Tx, tblname string, id VersionID, meta map[string]string) error {
+	if err := w.DeleteMetadata(ctx, tx, tblname, id); err != nil {
+		return err
+	}
+	format := `insert into %s(id,name,value) values(@p1,@p2,@p3);`
+	return commonInsertMetadata(ctx, tx, tblname, id, meta, format)
+}
+
+func (w *sqlserver) DeleteMetadata(ctx context.Context, tx *sql.Tx, tblname string, id VersionID) error {
+	format := `delete from %s where id = @p1`
+	return commonDeleteMetadata(ctx, tx, tblname, id, format)
+}
+
+func (w *sqlserver) ListMetadata(ctx context.Context, tx *sql.Tx, tblname string, id VersionID) (map[string]string, error) {
+	format := `select name,value from %s where id = @p1`
+	return commonListMetadata(ctx, tx, tblname, id, format)
+}
+
+// cockroach is the driver for CockroachDB, which is wire-compatible
+// with PostgreSQL. CockroachDB uses the same database/sql driver as
+// PostgreSQL, so its driver is selected by dialect name.
+type cockroach struct {
+	postgres
+}
+
+func (w *cockroach) Dialect() string {
+	return "cockroach"
+}
+
+func (w *cockroach) PackageNames() []string {
+	// the package name is the same as for postgres
+	return nil
+}
+
+// IsRetryable reports whether err is a serialization failure, which
+// CockroachDB returns when a transaction conflicts with another and
+// should be retried.
+func (w *cockroach) IsRetryable(err error) bool {
+	var pqErr interface{ Get(byte) string }
+	if errors.As(err, &pqErr) && pqErr.Get('C') == "40001" {
+		return true
+	}
+	var pgxErr interface{ SQLState() string }
+	if errors.As(err, &pgxErr) && pgxErr.SQLState() == "40001" {
+		return true
+	}
+	return strings.Contains(err.Error(), "restart transaction")
 }
 
-func (w *mysql) DeleteVersion(ctx context.Context, tx *sql.Tx, tblname string, id VersionID) error {
-	format := `delete from %s where id = ?;`
-	return commonDeleteVersion(ctx, tx, tblname, id, format)
+func (w *cockroach) AdvisoryLock(ctx context.Context, db *sql.DB, key string) (*sql.Conn, error) {
+	// CockroachDB does not support advisory locks
+	return nil, nil
 }
 
-func (w *mysql) ListVersions(ctx context.Context, tx *sql.Tx, tblname string) ([]*Version, error) {
-	return commonListVersions(ctx, tx, tblname)
+func (w *cockroach) AdvisoryUnlock(ctx context.Context, conn *sql.Conn, key string) error {
+	return nil
 }
 
-func (w *mysql) SetVersionFailed(ctx context.Context, tx *sql.Tx, tblname string, id VersionID, failed bool) error {
-	format := `update %s set failed = ? where id = ?`
-	return commonSetBool(ctx, tx, tblname, id, failed, format)
+// advisoryLockID returns the numeric id of the advisory lock for key.
+func advisoryLockID(key string) int64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return int64(h.Sum64())
 }
 
-func (w *mysql) SetVersionLocked(ctx context.Context, tx *sql.Tx, tblname string, id VersionID, locked bool) error {
-	format := `update %s set locked = ? where id = ?`
-	return commonSetBool(ctx, tx, tblname, id, locked, format)
+// commonAdvisoryLock acquires an advisory lock by executing query on a
+// dedicated connection. The lock is held until the connection is passed
+// to commonAdvisoryUnlock.
+func commonAdvisoryLock(ctx context.Context, db *sql.DB, query string, args ...interface{}) (*sql.Conn, error) {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, wrapf(err, "cannot acquire advisory lock")
+	}
+	if _, err = conn.ExecContext(ctx, query, args...); err != nil {
+		conn.Close()
+		return nil, wrapf(err, "cannot acquire advisory lock")
+	}
+	return conn, nil
 }
 
+// commonAdvisoryUnlock releases an advisory lock by executing query,
+// and closes the connection.
+func commonAdvisoryUnlock(ctx context.Context, conn *sql.Conn, query string, args ...interface{}) error {
+	if conn == nil {
+		return nil
+	}
+	defer conn.Close()
+	if _, err := conn.ExecContext(ctx, query, args...); err != nil {
+		return wrapf(err, "cannot release advisory lock")
+	}
+	return nil
+}
+
+// createTableAttempts is the number of times that creating a table
+// is attempted when it fails with a transient error.
+const createTableAttempts = 3
+
 func commonCreateMigrationsTable(ctx context.Context, db *sql.DB, tblname string, format string) error {
 	query := fmt.Sprintf(format, tblname)
-	_, err := db.ExecContext(ctx, query)
+	var err error
+	for attempt := 1; attempt <= createTableAttempts; attempt++ {
+		if _, err = db.ExecContext(ctx, query); err == nil || !isTransientDDLError(err) {
+			break
+		}
+		if attempt < createTableAttempts {
+			// another process is probably creating the same table
+			select {
+			case <-ctx.Done():
+				return wrapf(ctx.Err(), "cannot create table %s", tblname)
+			case <-time.After(time.Duration(attempt) * 50 * time.Millisecond):
+			}
+		}
+	}
 	if err != nil {
 		return wrapf(err, "cannot create table %s", tblname)
 	}
 	return nil
 }
 
-func commonInsertVersion(ctx context.Context, tx *sql.Tx, tblname string, ver *Version, format string) error {
-	query := fmt.Sprintf(format, tblname)
-	_, err := tx.ExecContext(ctx, query, ver.ID, *ver.AppliedAt, ver.Failed, ver.Locked)
+// isTransientDDLError reports whether err is a transient error that can
+// be returned by "create table if not exists" when another process is
+// creating the same table at the same time. PostgreSQL reports this as a
+// unique violation on its catalog tables, or as a concurrent update.
+func isTransientDDLError(err error) bool {
+	msg := err.Error()
+	return strings.Contains(msg, "duplicate key value violates unique constraint") ||
+		strings.Contains(msg, "tuple concurrently updated")
+}
+
+// commonAddColumns adds any missing columns to a migrations table
+// created by an earlier version of this package. Each column definition
+// starts with the column name.
+func commonAddColumns(ctx context.Context, db *sql.DB, tblname string, cols *Columns, coldefs ...string) error {
+	return addColumns(ctx, db, tblname, cols, "alter table %s add column %s", coldefs...)
+}
+
+// addColumns is like commonAddColumns, but uses format to build the
+// statement that adds a column, for databases with a different syntax.
+func addColumns(ctx context.Context, db *sql.DB, tblname string, cols *Columns, format string, coldefs ...string) error {
+	for _, coldef := range coldefs {
+		coldef = cols.expand(coldef)
+		column := strings.Fields(coldef)[0]
+		probe := fmt.Sprintf("select %s from %s where 1 = 0", column, tblname)
+		rows, err := db.QueryContext(ctx, probe)
+		if err == nil {
+			// column already exists
+			if err = rows.Close(); err != nil {
+				return wrapf(err, "cannot probe table %s", tblname)
+			}
+			continue
+		}
+		query := fmt.Sprintf(format, tblname, coldef)
+		if _, err = db.ExecContext(ctx, query); err != nil {
+			return wrapf(err, "cannot add column %s to table %s", column, tblname)
+		}
+	}
+	return nil
+}
+
+func commonInsertVersion(ctx context.Context, tx *sql.Tx, tblname string, cols *Columns, ver *Version, format string) error {
+	query := fmt.Sprintf(cols.expand(format), tblname)
+	environment := sql.NullString{String: ver.Environment, Valid: ver.Environment != ""}
+	checksum := sql.NullString{String: ver.Checksum, Valid: ver.Checksum != ""}
+	appliedBy := sql.NullString{String: ver.AppliedBy, Valid: ver.AppliedBy != ""}
+	_, err := tx.ExecContext(ctx, query, ver.ID, *ver.AppliedAt, ver.Failed, ver.Locked, environment, ver.Skipped, checksum, ver.Duration.Milliseconds(), appliedBy)
 	if err != nil {
 		return wrapf(err, "cannot insert migration version %d", ver.ID)
 	}
 	return nil
 }
 
-func commonDeleteVersion(ctx context.Context, tx *sql.Tx, tblname string, id VersionID, format string) error {
-	query := fmt.Sprintf(format, tblname)
+func commonDeleteVersion(ctx context.Context, tx *sql.Tx, tblname string, cols *Columns, id VersionID, format string) error {
+	query := fmt.Sprintf(cols.expand(format), tblname)
 	_, err := tx.ExecContext(ctx, query, id)
 	if err != nil {
 		return wrapf(err, "cannot delete migration version %d", id)
@@ -224,8 +1006,8 @@ func commonDeleteVersion(ctx context.Context, tx *sql.Tx, tblname string, id Ver
 	return nil
 }
 
-func commonSetBool(ctx context.Context, tx *sql.Tx, tblname string, id VersionID, boolval bool, format string) error {
-	query := fmt.Sprintf(format, tblname)
+func commonSetBool(ctx context.Context, tx *sql.Tx, tblname string, cols *Columns, id VersionID, boolval bool, format string) error {
+	query := fmt.Sprintf(cols.expand(format), tblname)
 	_, err := tx.ExecContext(ctx, query, boolval, id)
 	if err != nil {
 		return wrapf(err, "cannot update migration version %d", id)
@@ -233,24 +1015,151 @@ func commonSetBool(ctx context.Context, tx *sql.Tx, tblname string, id VersionID
 	return nil
 }
 
-func commonListVersions(ctx context.Context, tx *sql.Tx, tblname string) ([]*Version, error) {
-	var versions []*Version
-	format := `select id,applied_at,failed,locked from %s order by id`
+func commonRunCompleted(ctx context.Context, tx *sql.Tx, tblname string, runID string, format string) (bool, error) {
+	var count int
 	query := fmt.Sprintf(format, tblname)
+	if err := tx.QueryRowContext(ctx, query, runID).Scan(&count); err != nil {
+		return false, wrapf(err, "cannot query run %s", runID)
+	}
+	return count > 0, nil
+}
+
+func commonInsertRun(ctx context.Context, tx *sql.Tx, tblname string, runID string, completedAt time.Time, format string) error {
+	query := fmt.Sprintf(format, tblname)
+	_, err := tx.ExecContext(ctx, query, runID, completedAt)
+	if err != nil {
+		return wrapf(err, "cannot insert run %s", runID)
+	}
+	return nil
+}
+
+func commonSeedApplied(ctx context.Context, tx *sql.Tx, tblname string, name string, format string) (bool, error) {
+	var count int
+	query := fmt.Sprintf(format, tblname)
+	if err := tx.QueryRowContext(ctx, query, name).Scan(&count); err != nil {
+		return false, wrapf(err, "cannot query seed %s", name)
+	}
+	return count > 0, nil
+}
+
+func commonInsertSeed(ctx context.Context, tx *sql.Tx, tblname string, name string, appliedAt time.Time, format string) error {
+	query := fmt.Sprintf(format, tblname)
+	_, err := tx.ExecContext(ctx, query, name, appliedAt)
+	if err != nil {
+		return wrapf(err, "cannot insert seed %s", name)
+	}
+	return nil
+}
+
+func commonInsertMetadata(ctx context.Context, tx *sql.Tx, tblname string, id VersionID, meta map[string]string, format string) error {
+	query := fmt.Sprintf(format, tblname)
+	keys := make([]string, 0, len(meta))
+	for key := range meta {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if _, err := tx.ExecContext(ctx, query, id, key, meta[key]); err != nil {
+			return wrapf(err, "cannot insert metadata %s for version %d", key, id)
+		}
+	}
+	return nil
+}
+
+func commonDeleteMetadata(ctx context.Context, tx *sql.Tx, tblname string, id VersionID, format string) error {
+	query := fmt.Sprintf(format, tblname)
+	if _, err := tx.ExecContext(ctx, query, id); err != nil {
+		return wrapf(err, "cannot delete metadata for version %d", id)
+	}
+	return nil
+}
+
+func commonListMetadata(ctx context.Context, tx *sql.Tx, tblname string, id VersionID, format string) (map[string]string, error) {
+	query := fmt.Sprintf(format, tblname)
+	rows, err := tx.QueryContext(ctx, query, id)
+	if err != nil {
+		return nil, wrapf(err, "cannot query metadata for version %d", id)
+	}
+	defer rows.Close()
+	meta := make(map[string]string)
+	for rows.Next() {
+		var key, value string
+		if err = rows.Scan(&key, &value); err != nil {
+			return nil, wrapf(err, "cannot scan metadata for version %d", id)
+		}
+		meta[key] = value
+	}
+	if err = rows.Err(); err != nil {
+		return nil, wrapf(err, "cannot query metadata for version %d", id)
+	}
+	return meta, nil
+}
+
+// commonListVersions lists the versions in the migrations table. Columns
+// are matched by name, so that a table created by an earlier version of
+// this package, which may lack some columns, can still be listed.
+// Column names are mapped to their default names before matching.
+func commonListVersions(ctx context.Context, tx *sql.Tx, tblname string, cols *Columns) ([]*Version, error) {
+	var versions []*Version
+	format := `select * from %s order by {id}`
+	query := fmt.Sprintf(cols.expand(format), tblname)
 	rows, err := tx.QueryContext(ctx, query)
 	if err != nil {
 		return nil, wrapf(err, "cannot query versions")
 	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, wrapf(err, "cannot query versions")
+	}
 	for rows.Next() {
 		var (
-			ver       Version
-			appliedAt timeVal
+			ver         Version
+			appliedAt   timeVal
+			environment sql.NullString
+			checksum    sql.NullString
+			durationMS  sql.NullInt64
+			appliedBy   sql.NullString
 		)
 
-		if err = rows.Scan(&ver.ID, &appliedAt, &ver.Failed, &ver.Locked); err != nil {
+		dest := make([]interface{}, len(columns))
+		for i, column := range columns {
+			switch cols.role(column) {
+			case "id":
+				dest[i] = &ver.ID
+			case "applied_at":
+				dest[i] = &appliedAt
+			case "failed":
+				dest[i] = (*boolVal)(&ver.Failed)
+			case "locked":
+				dest[i] = (*boolVal)(&ver.Locked)
+			case "environment":
+				dest[i] = &environment
+			case "skipped":
+				dest[i] = (*boolVal)(&ver.Skipped)
+			case "checksum":
+				dest[i] = &checksum
+			case "duration_ms":
+				dest[i] = &durationMS
+			case "applied_by":
+				dest[i] = &appliedBy
+			default:
+				dest[i] = new(interface{})
+			}
+		}
+		if err = rows.Scan(dest...); err != nil {
 			return nil, wrapf(err, "cannot scan version")
 		}
-		ver.AppliedAt = &appliedAt.Time
+		if appliedAt.Valid {
+			ver.AppliedAt = &appliedAt.Time
+		} else {
+			// the version is applied, but when is not known
+			ver.Warning = "applied_at is null"
+		}
+		ver.Environment = environment.String
+		ver.Checksum = checksum.String
+		ver.Duration = time.Duration(durationMS.Int64) * time.Millisecond
+		ver.AppliedBy = appliedBy.String
 		versions = append(versions, &ver)
 	}
 	if err = rows.Err(); err != nil {
@@ -259,3 +1168,193 @@ func commonListVersions(ctx context.Context, tx *sql.Tx, tblname string) ([]*Ver
 
 	return versions, nil
 }
+
+// oracle is the driver for Oracle Database. Oracle has no boolean
+// column type, so boolean values are stored as NUMBER(1), with zero
+// meaning false. Oracle does not accept a semicolon at the end of
+// a statement.
+type oracle struct{}
+
+func (w *oracle) Dialect() string {
+	return "oracle"
+}
+
+func (w *oracle) PackageNames() []string {
+	return []string{"godror", "go_ora"}
+}
+
+func (w *oracle) IsRetryable(err error) bool {
+	return false
+}
+
+func (w *oracle) SupportsTransactionalDDL() bool {
+	// DDL statements commit the current transaction
+	return false
+}
+
+func (w *oracle) LockTimeoutSQL(timeout time.Duration) (string, string) {
+	// ddl_lock_timeout is in whole seconds
+	seconds := int64((timeout + time.Second - 1) / time.Second)
+	set := fmt.Sprintf("alter session set ddl_lock_timeout = %d", seconds)
+	return set, "alter session set ddl_lock_timeout = 0"
+}
+
+func (w *oracle) AdvisoryLock(ctx context.Context, db *sql.DB, key string) (*sql.Conn, error) {
+	// Oracle user locks require execute permission on the DBMS_LOCK
+	// package, which is not granted by default
+	return nil, nil
+}
+
+func (w *oracle) AdvisoryUnlock(ctx context.Context, conn *sql.Conn, key string) error {
+	return nil
+}
+
+func (w *oracle) CreateMigrationsTable(ctx context.Context, db *sql.DB, tblname string, cols *Columns) error {
+	format := `create table %s` +
+		`({id} number(19) primary key` +
+		`,{applied_at} timestamp not null` +
+		`,{failed} number(1) default 0 not null` +
+		`,{locked} number(1) default 0 not null` +
+		`,{environment} varchar2(255)` +
+		`,{skipped} number(1) default 0 not null` +
+		`,{checksum} varchar2(64)` +
+		`,{duration_ms} number(19) default 0 not null` +
+		`,{applied_by} varchar2(255)` +
+		`)`
+	return oracleCreateTable(ctx, db, tblname, cols.expand(format))
+}
+
+func (w *oracle) InsertVersion(ctx context.Context, tx *sql.Tx, tblname string, cols *Columns, ver *Version) error {
+	format := `insert into %s({id},{applied_at},{failed},{locked},{environment},{skipped},{checksum},{duration_ms},{applied_by}) values(:1,:2,:3,:4,:5,:6,:7,:8,:9)`
+	query := fmt.Sprintf(cols.expand(format), tblname)
+	environment := sql.NullString{String: ver.Environment, Valid: ver.Environment != ""}
+	checksum := sql.NullString{String: ver.Checksum, Valid: ver.Checksum != ""}
+	appliedBy := sql.NullString{String: ver.AppliedBy, Valid: ver.AppliedBy != ""}
+	_, err := tx.ExecContext(ctx, query, ver.ID, *ver.AppliedAt, oracleBool(ver.Failed), oracleBool(ver.Locked),
+		environment, oracleBool(ver.Skipped), checksum, ver.Duration.Milliseconds(), appliedBy)
+	if err != nil {
+		return wrapf(err, "cannot insert migration version %d", ver.ID)
+	}
+	return nil
+}
+
+func (w *oracle) DeleteVersion(ctx context.Context, tx *sql.Tx, tblname string, cols *Columns, id VersionID) error {
+	format := `delete from %s where {id} = :1`
+	return commonDeleteVersion(ctx, tx, tblname, cols, id, format)
+}
+
+func (w *oracle) ListVersions(ctx context.Context, tx *sql.Tx, tblname string, cols *Columns) ([]*Version, error) {
+	return commonListVersions(ctx, tx, tblname, cols)
+}
+
+func (w *oracle) SetVersionFailed(ctx context.Context, tx *sql.Tx, tblname string, cols *Columns, id VersionID, failed bool) error {
+	format := `update %s set {failed} = :1 where {id} = :2`
+	return oracleSetBool(ctx, tx, tblname, cols, id, failed, format)
+}
+
+func (w *oracle) SetVersionLocked(ctx context.Context, tx *sql.Tx, tblname string, cols *Columns, id VersionID, locked bool) error {
+	format := `update %s set {locked} = :1 where {id} = :2`
+	return oracleSetBool(ctx, tx, tblname, cols, id, locked, format)
+}
+
+func (w *oracle) CreateRunsTable(ctx context.Context, db *sql.DB, tblname string) error {
+	format := `create table %s` +
+		`(run_id varchar2(255) primary key` +
+		`,completed_at timestamp not null` +
+		`)`
+	return oracleCreateTable(ctx, db, tblname, format)
+}
+
+func (w *oracle) RunCompleted(ctx context.Context, tx *sql.Tx, tblname string, runID string) (bool, error) {
+	format := `select count(*) from %s where run_id = :1`
+	return commonRunCompleted(ctx, tx, tblname, runID, format)
+}
+
+func (w *oracle) InsertRun(ctx context.Context, tx *sql.Tx, tblname string, runID string, completedAt time.Time) error {
+	format := `insert into %s(run_id,completed_at) values(:1,:2)`
+	return commonInsertRun(ctx, tx, tblname, runID, completedAt, format)
+}
+
+func (w *oracle) CreateSeedsTable(ctx context.Context, db *sql.DB, tblname string) error {
+	format := `create table %s` +
+		`(name varchar2(255) primary key` +
+		`,applied_at timestamp not null` +
+		`)`
+	return oracleCreateTable(ctx, db, tblname, format)
+}
+
+func (w *oracle) SeedApplied(ctx context.Context, tx *sql.Tx, tblname string, name string) (bool, error) {
+	format := `select count(*) from %s where name = :1`
+	return commonSeedApplied(ctx, tx, tblname, name, format)
+}
+
+func (w *oracle) InsertSeed(ctx context.Context, tx *sql.Tx, tblname string, name string, appliedAt time.Time) error {
+	format := `insert into %s(name,applied_at) values(:1,:2)`
+	return commonInsertSeed(ctx, tx, tblname, name, appliedAt, format)
+}
+
+func (w *oracle) CreateMetadataTable(ctx context.Context, db *sql.DB, tblname string) error {
+	format := `create table %s` +
+		`(id number(19) not null` +
+		`,name varchar2(255) not null` +
+		`,value varchar2(4000) not null` +
+		`,primary key(id,name)` +
+		`)`
+	return oracleCreateTable(ctx, db, tblname, format)
+}
+
+func (w *oracle) InsertMetadata(ctx context.Context, tx *sql.Tx, tblname string, id VersionID, meta map[string]string) error {
+	if err := w.DeleteMetadata(ctx, tx, tblname, id); err != nil {
+		return err
+	}
+	format := `insert into %s(id,name,value) values(:1,:2,:3)`
+	return commonInsertMetadata(ctx, tx, tblname, id, meta, format)
+}
+
+func (w *oracle) DeleteMetadata(ctx context.Context, tx *sql.Tx, tblname string, id VersionID) error {
+	format := `delete from %s where id = :1`
+	return commonDeleteMetadata(ctx, tx, tblname, id, format)
+}
+
+func (w *oracle) ListMetadata(ctx context.Context, tx *sql.Tx, tblname string, id VersionID) (map[string]string, error) {
+	format := `select name,value from %s where id = :1`
+	return commonListMetadata(ctx, tx, tblname, id, format)
+}
+
+// oracleCreateTable creates a table using the create table statement in
+// format, unless the table already exists. Oracle does not support "create
+// table if not exists", so the table is only created if a query on it
+// fails. If another process creates the table first, the create table
+// statement fails with ORA-00955, which is ignored.
+func oracleCreateTable(ctx context.Context, db *sql.DB, tblname string, format string) error {
+	probe := fmt.Sprintf("select * from %s where 1 = 0", tblname)
+	if rows, err := db.QueryContext(ctx, probe); err == nil {
+		// table already exists
+		if err = rows.Close(); err != nil {
+			return wrapf(err, "cannot probe table %s", tblname)
+		}
+		return nil
+	}
+	err := commonCreateMigrationsTable(ctx, db, tblname, format)
+	if err != nil && strings.Contains(err.Error(), "ORA-00955") {
+		return nil
+	}
+	return err
+}
+
+func oracleSetBool(ctx context.Context, tx *sql.Tx, tblname string, cols *Columns, id VersionID, boolval bool, format string) error {
+	query := fmt.Sprintf(cols.expand(format), tblname)
+	_, err := tx.ExecContext(ctx, query, oracleBool(boolval), id)
+	if err != nil {
+		return wrapf(err, "cannot update migration version %d", id)
+	}
+	return nil
+}
+
+// oracleBool returns the NUMBER(1) value that represents b.
+func oracleBool(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
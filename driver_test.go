@@ -0,0 +1,532 @@
+package migration
+
+import (
+	"context"
+	"database/sql"
+	sqldriver "database/sql/driver"
+	"errors"
+	"io"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	sqlite3 "github.com/mattn/go-sqlite3"
+)
+
+func TestNewWorkerWithDialect(t *testing.T) {
+	ctx := context.Background()
+	rec := &recorder{}
+	db := sql.OpenDB(rec)
+	defer db.Close()
+
+	if _, err := NewWorker(db, newTestSchema()); err == nil {
+		t.Fatal("got=nil, want=error")
+	}
+
+	_, err := NewWorkerWithDialect(db, newTestSchema(), "db2")
+	wantError(t, err, "unknown migration dialect db2")
+
+	worker, err := NewWorkerWithDialect(db, newTestSchema(), "postgres")
+	wantNoError(t, err)
+	wantNoError(t, worker.init(ctx))
+
+	if got, want := rec.queries(), "applied_at timestamptz"; !strings.Contains(got, want) {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+}
+
+func TestSQLServerDriver(t *testing.T) {
+	ctx := context.Background()
+	rec := &recorder{}
+	db := sql.OpenDB(rec)
+	defer db.Close()
+
+	worker, err := NewWorkerWithDialect(db, newTestSchema(), "sqlserver")
+	wantNoError(t, err)
+	wantNoError(t, worker.init(ctx))
+	tx, err := db.BeginTx(ctx, nil)
+	wantNoError(t, err)
+	now := time.Now()
+	wantNoError(t, worker.drv.InsertVersion(ctx, tx, "schema_migrations", nil, &Version{ID: 10, AppliedAt: &now}))
+	wantNoError(t, tx.Commit())
+
+	for _, want := range []string{
+		"if object_id('schema_migrations', 'U') is null create table schema_migrations(id bigint primary key,",
+		"applied_at datetime2 not null,failed bit not null,locked bit not null",
+		"create table schema_migrations_metadata(id bigint not null,",
+		"insert into schema_migrations(id,applied_at,failed,locked,environment,skipped,checksum,duration_ms,applied_by) values(@p1,@p2,@p3,@p4,@p5,@p6,@p7,@p8,@p9);",
+	} {
+		if got := rec.queries(); !strings.Contains(got, want) {
+			t.Errorf("got=%v, want=%v", got, want)
+		}
+	}
+
+	worker, err = NewWorkerNamed(db, newTestSchema(), "sqlserver")
+	wantNoError(t, err)
+	if got, want := worker.drv.SupportsTransactionalDDL(), true; got != want {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+}
+
+func TestOracleDriver(t *testing.T) {
+	ctx := context.Background()
+	rec := &recorder{queryErrs: []error{errors.New("ORA-00942: table or view does not exist")}}
+	db := sql.OpenDB(rec)
+	defer db.Close()
+
+	worker, err := NewWorkerWithDialect(db, newTestSchema(), "oracle")
+	wantNoError(t, err)
+	if got, want := worker.drv.SupportsTransactionalDDL(), false; got != want {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+	wantNoError(t, worker.init(ctx))
+	tx, err := db.BeginTx(ctx, nil)
+	wantNoError(t, err)
+	now := time.Now()
+	wantNoError(t, worker.drv.InsertVersion(ctx, tx, "schema_migrations", nil, &Version{ID: 10, AppliedAt: &now}))
+	wantNoError(t, worker.drv.SetVersionLocked(ctx, tx, "schema_migrations", nil, 10, true))
+	wantNoError(t, tx.Commit())
+
+	for _, want := range []string{
+		"select * from schema_migrations where 1 = 0",
+		"create table schema_migrations(id number(19) primary key,applied_at timestamp not null,failed number(1) default 0 not null",
+		"insert into schema_migrations(id,applied_at,failed,locked,environment,skipped,checksum,duration_ms,applied_by) values(:1,:2,:3,:4,:5,:6,:7,:8,:9)",
+		"update schema_migrations set locked = :1 where id = :2",
+	} {
+		if got := rec.queries(); !strings.Contains(got, want) {
+			t.Errorf("got=%v, want=%v", got, want)
+		}
+	}
+	if got := rec.queries(); strings.Contains(got, ";") {
+		t.Errorf("got=%v, want no semicolons", got)
+	}
+	if got := rec.queries(); strings.Contains(got, "alter table") {
+		t.Errorf("got=%v, want no alter table", got)
+	}
+
+	// the table already exists, or was created by another process
+	rec = &recorder{}
+	db2 := sql.OpenDB(rec)
+	defer db2.Close()
+	worker, err = NewWorkerNamed(db2, newTestSchema(), "godror")
+	wantNoError(t, err)
+	wantNoError(t, worker.init(ctx))
+	if got := rec.queries(); strings.Contains(got, "create table") {
+		t.Errorf("got=%v, want no create table", got)
+	}
+
+	rec = &recorder{
+		queryErrs: []error{errors.New("ORA-00942: table or view does not exist")},
+		execErrs:  []error{errors.New("ORA-00955: name is already used by an existing object")},
+	}
+	db3 := sql.OpenDB(rec)
+	defer db3.Close()
+	worker, err = NewWorkerWithDialect(db3, newTestSchema(), "oracle")
+	wantNoError(t, err)
+	wantNoError(t, worker.init(ctx))
+}
+
+// serializationError mimics the error returned by the pq driver
+// for a serialization failure.
+type serializationError struct{}
+
+func (serializationError) Error() string { return "pq: restart transaction" }
+
+func (serializationError) Get(k byte) string {
+	if k == 'C' {
+		return "40001"
+	}
+	return ""
+}
+
+func TestCockroachDriver(t *testing.T) {
+	ctx := context.Background()
+	rec := &recorder{}
+	db := sql.OpenDB(rec)
+	defer db.Close()
+
+	worker, err := NewWorkerWithDialect(db, newTestSchema(), "cockroach")
+	wantNoError(t, err)
+	wantNoError(t, worker.init(ctx))
+	if got, want := rec.queries(), "applied_at timestamptz"; !strings.Contains(got, want) {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+
+	var attempts int
+	err = worker.migrationTx(ctx, func(tx *sql.Tx) error {
+		attempts++
+		if attempts < 3 {
+			return wrapf(serializationError{}, "10")
+		}
+		return nil
+	})
+	wantNoError(t, err)
+	if got, want := attempts, 3; got != want {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+
+	// other errors are not retried
+	attempts = 0
+	err = worker.migrationTx(ctx, func(tx *sql.Tx) error {
+		attempts++
+		return errors.New("permission denied")
+	})
+	wantError(t, err, "permission denied")
+	if got, want := attempts, 1; got != want {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+
+	// postgres does not retry serialization failures
+	worker, err = NewWorkerWithDialect(db, newTestSchema(), "postgres")
+	wantNoError(t, err)
+	if worker.drv.IsRetryable(serializationError{}) {
+		t.Error("got=true, want=false")
+	}
+}
+
+func TestRetryReadPath(t *testing.T) {
+	ctx := context.Background()
+	conn := &failCommit{}
+	db := sql.OpenDB(conn)
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	schema := newTestSchema()
+	schema.Define(30).UpAction(DBFunc(func(ctx context.Context, db *sql.DB) error {
+		return errors.New("partial failure")
+	})).Down("select 1")
+	worker, err := NewWorkerWithDialect(db, schema, "sqlite")
+	wantNoError(t, err)
+	worker.drv = &retryingSQLite{}
+	_, err = worker.UpN(ctx, 1)
+	wantNoError(t, err)
+
+	// read transactions are not retried, so their results are not
+	// accumulated twice
+	conn.failures = 1
+	_, err = worker.Pending(ctx)
+	wantError(t, err, "restart transaction")
+	pending, err := worker.Pending(ctx)
+	wantNoError(t, err)
+	if got, want := len(pending), 2; got != want {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+	wantError(t, worker.Up(ctx), "partial failure")
+	conn.failures = 1
+	wantError(t, worker.CleanupFailed(ctx), "restart transaction")
+	wantNoError(t, worker.CleanupFailed(ctx))
+
+	// migration transactions are retried
+	conn.failures = 2
+	var attempts int
+	err = worker.migrationTx(ctx, func(tx *sql.Tx) error {
+		attempts++
+		return nil
+	})
+	wantNoError(t, err)
+	if got, want := attempts, 3; got != want {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+}
+
+// retryingSQLite is a sqlite driver that retries serialization
+// failures, as the cockroach driver does.
+type retryingSQLite struct {
+	sqlite
+}
+
+func (w *retryingSQLite) IsRetryable(err error) bool {
+	return errors.As(err, new(serializationError))
+}
+
+// failCommit is a database/sql connector for an in-memory sqlite
+// database, whose transactions fail to commit with a serialization
+// error while failures is positive.
+type failCommit struct {
+	sqlite3.SQLiteDriver
+	failures int
+}
+
+func (d *failCommit) Connect(context.Context) (sqldriver.Conn, error) {
+	conn, err := d.Open(":memory:")
+	if err != nil {
+		return nil, err
+	}
+	return failCommitConn{Conn: conn, d: d}, nil
+}
+
+func (d *failCommit) Driver() sqldriver.Driver { return d }
+
+type failCommitConn struct {
+	sqldriver.Conn
+	d *failCommit
+}
+
+func (c failCommitConn) Begin() (sqldriver.Tx, error) {
+	tx, err := c.Conn.Begin()
+	if err != nil {
+		return nil, err
+	}
+	return failCommitTx{Tx: tx, d: c.d}, nil
+}
+
+type failCommitTx struct {
+	sqldriver.Tx
+	d *failCommit
+}
+
+func (tx failCommitTx) Commit() error {
+	if tx.d.failures > 0 {
+		tx.d.failures--
+		tx.Tx.Rollback()
+		return serializationError{}
+	}
+	return tx.Tx.Commit()
+}
+
+func TestAdvisoryLock(t *testing.T) {
+	ctx := context.Background()
+	for _, tt := range []struct {
+		dialect string
+		lock    string
+		unlock  string
+	}{
+		{"postgres", "select pg_advisory_lock($1)", "select pg_advisory_unlock($1)"},
+		{"mysql", "select get_lock(?, -1)", "select release_lock(?)"},
+		{"sqlserver", "exec sp_getapplock", "exec sp_releaseapplock"},
+	} {
+		rec := &recorder{}
+		db := sql.OpenDB(rec)
+		worker, err := NewWorkerWithDialect(db, newTestSchema(), tt.dialect)
+		wantNoError(t, err)
+		release, err := worker.advisoryLock(ctx)
+		wantNoError(t, err)
+		if got := rec.queries(); !strings.Contains(got, tt.lock) || strings.Contains(got, tt.unlock) {
+			t.Errorf("%s: got=%v, want=%v", tt.dialect, got, tt.lock)
+		}
+		release()
+		if got := rec.queries(); !strings.Contains(got, tt.unlock) {
+			t.Errorf("%s: got=%v, want=%v", tt.dialect, got, tt.unlock)
+		}
+		db.Close()
+	}
+}
+
+func TestNewWorkerNamed(t *testing.T) {
+	ctx := context.Background()
+	rec := &recorder{}
+	db := sql.OpenDB(rec)
+	defer db.Close()
+
+	_, err := NewWorkerNamed(db, newTestSchema(), "migration_test_proxy")
+	wantError(t, err, "no migration driver registered for migration_test_proxy")
+
+	drv, err := DialectDriver("postgres")
+	wantNoError(t, err)
+	RegisterDriverForName("migration_test_proxy", drv)
+	worker, err := NewWorkerNamed(db, newTestSchema(), "migration_test_proxy")
+	wantNoError(t, err)
+	wantNoError(t, worker.init(ctx))
+	if got, want := rec.queries(), "applied_at timestamptz"; !strings.Contains(got, want) {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+
+	worker, err = NewWorkerNamed(db, newTestSchema(), "sqlite3")
+	wantNoError(t, err)
+	if got, want := worker.drv.Dialect(), "sqlite"; got != want {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+}
+
+// customDriver is a driver for a database that is not built in.
+type customDriver struct {
+	Driver
+}
+
+func (d customDriver) PackageNames() []string { return []string{"migration"} }
+
+func TestRegisterDriver(t *testing.T) {
+	ctx := context.Background()
+	defer func(saved []Driver) { drivers = saved }(drivers)
+
+	rec := &recorder{}
+	db := sql.OpenDB(rec)
+	defer db.Close()
+
+	if _, err := NewWorker(db, newTestSchema()); err == nil {
+		t.Fatal("want error, got nil")
+	}
+
+	drv, err := DialectDriver("postgres")
+	wantNoError(t, err)
+	RegisterDriver(customDriver{drv})
+	worker, err := NewWorker(db, newTestSchema())
+	wantNoError(t, err)
+	wantNoError(t, worker.init(ctx))
+	if got, want := rec.queries(), "applied_at timestamptz"; !strings.Contains(got, want) {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+
+	defer func() {
+		if got, want := recover(), "migration: RegisterDriver called twice for package migration"; got != want {
+			t.Errorf("got=%v, want=%v", got, want)
+		}
+	}()
+	RegisterDriver(customDriver{drv})
+}
+
+func TestCreateTableRetry(t *testing.T) {
+	ctx := context.Background()
+	transient := errors.New(`pq: duplicate key value violates unique constraint "pg_type_typname_nsp_index"`)
+	rec := &recorder{execErrs: []error{transient}}
+	db := sql.OpenDB(rec)
+	defer db.Close()
+
+	worker, err := NewWorkerWithDialect(db, newTestSchema(), "postgres")
+	wantNoError(t, err)
+	wantNoError(t, worker.init(ctx))
+	if got, want := strings.Count(rec.queries(), "create table if not exists schema_migrations("), 2; got != want {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+
+	// other errors are not retried
+	rec = &recorder{execErrs: []error{errors.New("permission denied")}}
+	db2 := sql.OpenDB(rec)
+	defer db2.Close()
+	worker, err = NewWorkerWithDialect(db2, newTestSchema(), "postgres")
+	wantNoError(t, err)
+	wantError(t, worker.init(ctx), "permission denied")
+	if got, want := strings.Count(rec.queries(), "create table if not exists schema_migrations("), 1; got != want {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+}
+
+func TestLockTimeoutSQLRoundsUp(t *testing.T) {
+	tests := []struct {
+		dialect string
+		timeout time.Duration
+		want    string
+	}{
+		{"postgres", time.Microsecond, "set lock_timeout = 1"},
+		{"postgres", 1500 * time.Microsecond, "set lock_timeout = 2"},
+		{"cockroach", time.Microsecond, "set lock_timeout = 1"},
+		{"mysql", time.Millisecond, "set session innodb_lock_wait_timeout = 1"},
+		{"mysql", 1500 * time.Millisecond, "set session innodb_lock_wait_timeout = 2"},
+		{"sqlserver", time.Microsecond, "set lock_timeout 1"},
+		{"oracle", time.Millisecond, "alter session set ddl_lock_timeout = 1"},
+	}
+	for _, tt := range tests {
+		drv, err := DialectDriver(tt.dialect)
+		wantNoError(t, err)
+		if got, _ := drv.LockTimeoutSQL(tt.timeout); got != tt.want {
+			t.Errorf("%s %v: got=%q, want=%q", tt.dialect, tt.timeout, got, tt.want)
+		}
+	}
+}
+
+var registerLockingDriver sync.Once
+
+func TestVerifyAllDriversAdvisoryLock(t *testing.T) {
+	registerLockingDriver.Do(func() {
+		sql.Register("sqlite3-locking", &sqlite3.SQLiteDriver{})
+		RegisterDriverForName("sqlite3-locking", &lockingSQLite{})
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err := VerifyAllDrivers(ctx, newTestSchema(), map[string]string{
+		"sqlite3-locking": filepath.Join(t.TempDir(), "verify.db"),
+	})
+	wantNoError(t, err)
+}
+
+// lockingSQLite is a sqlite driver that holds its advisory lock on a
+// dedicated connection, as the postgres and mysql drivers do.
+type lockingSQLite struct {
+	sqlite
+}
+
+func (w *lockingSQLite) Dialect() string {
+	return "sqlite-locking"
+}
+
+func (w *lockingSQLite) AdvisoryLock(ctx context.Context, db *sql.DB, key string) (*sql.Conn, error) {
+	return commonAdvisoryLock(ctx, db, `select 1`)
+}
+
+func (w *lockingSQLite) AdvisoryUnlock(ctx context.Context, conn *sql.Conn, key string) error {
+	return commonAdvisoryUnlock(ctx, conn, `select 1`)
+}
+
+// recorder is a database/sql driver that records the queries it is
+// asked to execute. Queries return no rows.
+type recorder struct {
+	mu        sync.Mutex
+	log       []string
+	execErrs  []error // errors returned by successive calls to Exec
+	queryErrs []error // errors returned by successive calls to Query
+}
+
+func (r *recorder) queries() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return strings.Join(r.log, "\n")
+}
+
+func (r *recorder) record(query string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.log = append(r.log, query)
+}
+
+func (r *recorder) Connect(context.Context) (sqldriver.Conn, error) { return r, nil }
+func (r *recorder) Driver() sqldriver.Driver                        { return r }
+func (r *recorder) Open(string) (sqldriver.Conn, error)             { return r, nil }
+func (r *recorder) Prepare(query string) (sqldriver.Stmt, error)    { return recorderStmt{r, query}, nil }
+func (r *recorder) Close() error                                    { return nil }
+func (r *recorder) Begin() (sqldriver.Tx, error)                    { return r, nil }
+func (r *recorder) Commit() error                                   { return nil }
+func (r *recorder) Rollback() error                                 { return nil }
+
+type recorderStmt struct {
+	r     *recorder
+	query string
+}
+
+func (s recorderStmt) Close() error  { return nil }
+func (s recorderStmt) NumInput() int { return -1 }
+
+func (s recorderStmt) Exec(args []sqldriver.Value) (sqldriver.Result, error) {
+	s.r.record(s.query)
+	s.r.mu.Lock()
+	defer s.r.mu.Unlock()
+	if len(s.r.execErrs) > 0 {
+		err := s.r.execErrs[0]
+		s.r.execErrs = s.r.execErrs[1:]
+		if err != nil {
+			return nil, err
+		}
+	}
+	return sqldriver.RowsAffected(0), nil
+}
+
+func (s recorderStmt) Query(args []sqldriver.Value) (sqldriver.Rows, error) {
+	s.r.record(s.query)
+	s.r.mu.Lock()
+	defer s.r.mu.Unlock()
+	if len(s.r.queryErrs) > 0 {
+		err := s.r.queryErrs[0]
+		s.r.queryErrs = s.r.queryErrs[1:]
+		if err != nil {
+			return nil, err
+		}
+	}
+	return recorderRows{}, nil
+}
+
+type recorderRows struct{}
+
+func (recorderRows) Columns() []string                 { return nil }
+func (recorderRows) Close() error                      { return nil }
+func (recorderRows) Next(dest []sqldriver.Value) error { return io.EOF }
@@ -0,0 +1,391 @@
+package migration
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// DumpSchemaDDL returns the statements that create the tables, indexes
+// and views in the database, which can be used as the up migration for
+// the first version of a schema. The migrations tables, named using
+// DefaultMigrationsTable, are not included.
+//
+// For SQLite the statements are read from sqlite_master, and for MySQL
+// they are read using SHOW CREATE. For PostgreSQL the tables are
+// reconstructed from information_schema, which includes columns, defaults
+// and primary keys, but not other constraints such as foreign keys.
+// SQL Server tables are reconstructed in the same way, and indexes
+// are not included. For Oracle the statements for tables and views are
+// read using DBMS_METADATA, and indexes are not included. In all cases
+// the output should be reviewed before use.
+func DumpSchemaDDL(ctx context.Context, db *sql.DB) (string, error) {
+	drv, err := findDriver(db)
+	if err != nil {
+		return "", err
+	}
+	stmts, err := drv.DumpSchemaDDL(ctx, db)
+	if err != nil {
+		return "", err
+	}
+	if len(stmts) == 0 {
+		return "", nil
+	}
+	for i, stmt := range stmts {
+		stmts[i] = strings.TrimSuffix(strings.TrimSpace(stmt), ";") + ";"
+	}
+	return strings.Join(stmts, "\n\n") + "\n", nil
+}
+
+// isMigrationsTable reports whether table is one of the tables created
+// by a worker using the default migrations table name.
+func isMigrationsTable(table string) bool {
+	switch strings.ToLower(table) {
+	case DefaultMigrationsTable,
+		DefaultMigrationsTable + "_runs",
+		DefaultMigrationsTable + "_metadata",
+		DefaultMigrationsTable + "_seeds":
+		return true
+	}
+	return false
+}
+
+func (w *sqlite) DumpSchemaDDL(ctx context.Context, db *sql.DB) ([]string, error) {
+	const query = `select tbl_name, sql from sqlite_master` +
+		` where sql is not null and name not like 'sqlite_%'` +
+		` order by case type when 'table' then 1 when 'index' then 2 when 'view' then 3 else 4 end, rowid`
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, wrapf(err, "cannot query sqlite_master")
+	}
+	defer rows.Close()
+	var stmts []string
+	for rows.Next() {
+		var table, stmt string
+		if err = rows.Scan(&table, &stmt); err != nil {
+			return nil, wrapf(err, "cannot scan sqlite_master")
+		}
+		if !isMigrationsTable(table) {
+			stmts = append(stmts, stmt)
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, wrapf(err, "cannot query sqlite_master")
+	}
+	return stmts, nil
+}
+
+func (w *mysql) DumpSchemaDDL(ctx context.Context, db *sql.DB) ([]string, error) {
+	const query = `select table_name, table_type from information_schema.tables` +
+		` where table_schema = database()` +
+		` order by case table_type when 'BASE TABLE' then 1 else 2 end, table_name`
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, wrapf(err, "cannot query tables")
+	}
+	var tables, types []string
+	for rows.Next() {
+		var table, tableType string
+		if err = rows.Scan(&table, &tableType); err != nil {
+			rows.Close()
+			return nil, wrapf(err, "cannot scan tables")
+		}
+		tables = append(tables, table)
+		types = append(types, tableType)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, wrapf(err, "cannot query tables")
+	}
+
+	var stmts []string
+	for i, table := range tables {
+		if isMigrationsTable(table) {
+			continue
+		}
+		kind := "table"
+		if types[i] == "VIEW" {
+			kind = "view"
+		}
+		// the result columns differ for tables and views
+		rows, err := db.QueryContext(ctx, fmt.Sprintf("show create %s `%s`", kind, table))
+		if err != nil {
+			return nil, wrapf(err, "cannot show create %s %s", kind, table)
+		}
+		cols, err := rows.Columns()
+		if err != nil {
+			rows.Close()
+			return nil, wrapf(err, "cannot show create %s %s", kind, table)
+		}
+		values := make([]sql.NullString, len(cols))
+		dest := make([]interface{}, len(cols))
+		for j := range values {
+			dest[j] = &values[j]
+		}
+		if rows.Next() {
+			err = rows.Scan(dest...)
+		}
+		rows.Close()
+		if err != nil {
+			return nil, wrapf(err, "cannot show create %s %s", kind, table)
+		}
+		stmts = append(stmts, values[1].String)
+	}
+	return stmts, nil
+}
+
+func (w *postgres) DumpSchemaDDL(ctx context.Context, db *sql.DB) ([]string, error) {
+	tables, err := queryStrings(ctx, db, `select table_name from information_schema.tables`+
+		` where table_schema = current_schema() and table_type = 'BASE TABLE'`+
+		` order by table_name`)
+	if err != nil {
+		return nil, wrapf(err, "cannot query tables")
+	}
+
+	var stmts []string
+	for _, table := range tables {
+		if isMigrationsTable(table) {
+			continue
+		}
+		stmt, err := w.dumpTable(ctx, db, table)
+		if err != nil {
+			return nil, err
+		}
+		stmts = append(stmts, stmt)
+	}
+
+	// indexes other than those created by primary key and unique constraints
+	rows, err := db.QueryContext(ctx, `select tablename, indexdef from pg_indexes`+
+		` where schemaname = current_schema() and indexname not in (`+
+		`select constraint_name from information_schema.table_constraints`+
+		` where table_schema = current_schema() and constraint_type in ('PRIMARY KEY', 'UNIQUE'))`+
+		` order by tablename, indexname`)
+	if err != nil {
+		return nil, wrapf(err, "cannot query indexes")
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var table, stmt string
+		if err = rows.Scan(&table, &stmt); err != nil {
+			return nil, wrapf(err, "cannot scan indexes")
+		}
+		if !isMigrationsTable(table) {
+			stmts = append(stmts, stmt)
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, wrapf(err, "cannot query indexes")
+	}
+
+	views, err := db.QueryContext(ctx, `select table_name, view_definition from information_schema.views`+
+		` where table_schema = current_schema() order by table_name`)
+	if err != nil {
+		return nil, wrapf(err, "cannot query views")
+	}
+	defer views.Close()
+	for views.Next() {
+		var name, definition string
+		if err = views.Scan(&name, &definition); err != nil {
+			return nil, wrapf(err, "cannot scan views")
+		}
+		stmts = append(stmts, fmt.Sprintf("create view %s as\n%s", name, definition))
+	}
+	if err = views.Err(); err != nil {
+		return nil, wrapf(err, "cannot query views")
+	}
+	return stmts, nil
+}
+
+// dumpTable reconstructs the create table statement for a table
+// from information_schema.
+func (w *postgres) dumpTable(ctx context.Context, db *sql.DB, table string) (string, error) {
+	rows, err := db.QueryContext(ctx, `select column_name, data_type, udt_name,`+
+		` character_maximum_length, is_nullable, column_default`+
+		` from information_schema.columns`+
+		` where table_schema = current_schema() and table_name = $1`+
+		` order by ordinal_position`, table)
+	if err != nil {
+		return "", wrapf(err, "cannot query columns for %s", table)
+	}
+	defer rows.Close()
+	var coldefs []string
+	for rows.Next() {
+		var (
+			name, dataType, udtName, nullable string
+			maxLength                         sql.NullInt64
+			defaultValue                      sql.NullString
+		)
+		if err = rows.Scan(&name, &dataType, &udtName, &maxLength, &nullable, &defaultValue); err != nil {
+			return "", wrapf(err, "cannot scan columns for %s", table)
+		}
+		switch dataType {
+		case "USER-DEFINED":
+			dataType = udtName
+		case "ARRAY":
+			dataType = strings.TrimPrefix(udtName, "_") + "[]"
+		}
+		coldef := name + " " + dataType
+		if maxLength.Valid {
+			coldef += fmt.Sprintf("(%d)", maxLength.Int64)
+		}
+		if nullable == "NO" {
+			coldef += " not null"
+		}
+		if defaultValue.Valid {
+			coldef += " default " + defaultValue.String
+		}
+		coldefs = append(coldefs, coldef)
+	}
+	if err = rows.Err(); err != nil {
+		return "", wrapf(err, "cannot query columns for %s", table)
+	}
+
+	pk, err := queryStrings(ctx, db, `select kcu.column_name`+
+		` from information_schema.table_constraints tc`+
+		` join information_schema.key_column_usage kcu`+
+		` on kcu.constraint_name = tc.constraint_name and kcu.table_schema = tc.table_schema`+
+		` where tc.constraint_type = 'PRIMARY KEY'`+
+		` and tc.table_schema = current_schema() and tc.table_name = $1`+
+		` order by kcu.ordinal_position`, table)
+	if err != nil {
+		return "", wrapf(err, "cannot query primary key for %s", table)
+	}
+	if len(pk) > 0 {
+		coldefs = append(coldefs, fmt.Sprintf("primary key (%s)", strings.Join(pk, ", ")))
+	}
+	return fmt.Sprintf("create table %s (\n\t%s\n)", table, strings.Join(coldefs, ",\n\t")), nil
+}
+
+func (w *sqlserver) DumpSchemaDDL(ctx context.Context, db *sql.DB) ([]string, error) {
+	tables, err := queryStrings(ctx, db, `select table_name from information_schema.tables`+
+		` where table_schema = schema_name() and table_type = 'BASE TABLE'`+
+		` order by table_name`)
+	if err != nil {
+		return nil, wrapf(err, "cannot query tables")
+	}
+
+	var stmts []string
+	for _, table := range tables {
+		if isMigrationsTable(table) {
+			continue
+		}
+		stmt, err := w.dumpTable(ctx, db, table)
+		if err != nil {
+			return nil, err
+		}
+		stmts = append(stmts, stmt)
+	}
+
+	// view_definition contains the complete create view statement
+	views, err := queryStrings(ctx, db, `select view_definition from information_schema.views`+
+		` where table_schema = schema_name() order by table_name`)
+	if err != nil {
+		return nil, wrapf(err, "cannot query views")
+	}
+	return append(stmts, views...), nil
+}
+
+// dumpTable reconstructs the create table statement for a table
+// from information_schema.
+func (w *sqlserver) dumpTable(ctx context.Context, db *sql.DB, table string) (string, error) {
+	rows, err := db.QueryContext(ctx, `select column_name, data_type,`+
+		` character_maximum_length, is_nullable, column_default`+
+		` from information_schema.columns`+
+		` where table_schema = schema_name() and table_name = @p1`+
+		` order by ordinal_position`, table)
+	if err != nil {
+		return "", wrapf(err, "cannot query columns for %s", table)
+	}
+	defer rows.Close()
+	var coldefs []string
+	for rows.Next() {
+		var (
+			name, dataType, nullable string
+			maxLength                sql.NullInt64
+			defaultValue             sql.NullString
+		)
+		if err = rows.Scan(&name, &dataType, &maxLength, &nullable, &defaultValue); err != nil {
+			return "", wrapf(err, "cannot scan columns for %s", table)
+		}
+		coldef := name + " " + dataType
+		switch {
+		case !maxLength.Valid:
+		case maxLength.Int64 < 0:
+			coldef += "(max)"
+		default:
+			coldef += fmt.Sprintf("(%d)", maxLength.Int64)
+		}
+		if nullable == "NO" {
+			coldef += " not null"
+		}
+		if defaultValue.Valid {
+			coldef += " default " + defaultValue.String
+		}
+		coldefs = append(coldefs, coldef)
+	}
+	if err = rows.Err(); err != nil {
+		return "", wrapf(err, "cannot query columns for %s", table)
+	}
+
+	pk, err := queryStrings(ctx, db, `select kcu.column_name`+
+		` from information_schema.table_constraints tc`+
+		` join information_schema.key_column_usage kcu`+
+		` on kcu.constraint_name = tc.constraint_name and kcu.table_schema = tc.table_schema`+
+		` where tc.constraint_type = 'PRIMARY KEY'`+
+		` and tc.table_schema = schema_name() and tc.table_name = @p1`+
+		` order by kcu.ordinal_position`, table)
+	if err != nil {
+		return "", wrapf(err, "cannot query primary key for %s", table)
+	}
+	if len(pk) > 0 {
+		coldefs = append(coldefs, fmt.Sprintf("primary key (%s)", strings.Join(pk, ", ")))
+	}
+	return fmt.Sprintf("create table %s (\n\t%s\n)", table, strings.Join(coldefs, ",\n\t")), nil
+}
+
+// DumpSchemaDDL reads the table and view statements using DBMS_METADATA.
+func (w *oracle) DumpSchemaDDL(ctx context.Context, db *sql.DB) ([]string, error) {
+	var stmts []string
+	for _, kind := range []string{"TABLE", "VIEW"} {
+		query := `select table_name from user_tables order by table_name`
+		if kind == "VIEW" {
+			query = `select view_name from user_views order by view_name`
+		}
+		names, err := queryStrings(ctx, db, query)
+		if err != nil {
+			return nil, wrapf(err, "cannot query %ss", strings.ToLower(kind))
+		}
+		for _, name := range names {
+			if isMigrationsTable(name) {
+				continue
+			}
+			ddl, err := queryStrings(ctx, db, `select dbms_metadata.get_ddl(:1, :2) from dual`, kind, name)
+			if err != nil {
+				return nil, wrapf(err, "cannot get ddl for %s", name)
+			}
+			stmts = append(stmts, ddl...)
+		}
+	}
+	return stmts, nil
+}
+
+// queryStrings returns the first column of each row returned by query.
+func queryStrings(ctx context.Context, db *sql.DB, query string, args ...interface{}) ([]string, error) {
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var values []string
+	for rows.Next() {
+		var value string
+		if err = rows.Scan(&value); err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return values, nil
+}
@@ -0,0 +1,53 @@
+package migration
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"testing"
+)
+
+func TestDumpSchemaDDL(t *testing.T) {
+	ctx := context.Background()
+	open := func() *sql.DB {
+		db, err := sql.Open("sqlite3", ":memory:")
+		wantNoError(t, err)
+		db.SetMaxOpenConns(1)
+		return db
+	}
+
+	var schema Schema
+	schema.Define(1).Up(`
+		create table city(id integer primary key, name text not null);
+		create index ix_city_name on city(name);
+		create view v_city as select name from city;
+	`).Down(`drop view v_city; drop table city;`)
+
+	db := open()
+	defer db.Close()
+	worker, err := NewWorker(db, &schema)
+	wantNoError(t, err)
+	wantNoError(t, worker.Up(ctx))
+
+	ddl, err := DumpSchemaDDL(ctx, db)
+	wantNoError(t, err)
+	for _, want := range []string{"CREATE TABLE city", "CREATE INDEX ix_city_name", "CREATE VIEW v_city"} {
+		if !strings.Contains(ddl, want) {
+			t.Errorf("got=%v, want=%v", ddl, want)
+		}
+	}
+	if strings.Contains(ddl, DefaultMigrationsTable) {
+		t.Errorf("got=%v, want no migrations table", ddl)
+	}
+
+	// the DDL round-trips through a new database
+	db2 := open()
+	defer db2.Close()
+	_, err = db2.ExecContext(ctx, ddl)
+	wantNoError(t, err)
+	ddl2, err := DumpSchemaDDL(ctx, db2)
+	wantNoError(t, err)
+	if ddl2 != ddl {
+		t.Errorf("got=%v, want=%v", ddl2, ddl)
+	}
+}
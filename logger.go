@@ -0,0 +1,12 @@
+package migration
+
+import "time"
+
+// A Logger receives structured progress events from a worker, for
+// use with structured logging packages. Direction is either "up" or
+// "down". MigrationFinished is called whether or not the migration
+// succeeds, and err is nil if it succeeded.
+type Logger interface {
+	MigrationStarted(id VersionID, direction string)
+	MigrationFinished(id VersionID, duration time.Duration, err error)
+}
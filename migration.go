@@ -65,6 +65,7 @@
 package migration
 
 import (
+	"errors"
 	"fmt"
 	"strings"
 	"time"
@@ -77,6 +78,38 @@ const (
 	DefaultMigrationsTable = "schema_migrations"
 )
 
+// ErrNothingToDo is returned by the Up, Down and Goto methods when
+// there are no migrations to perform and Worker.ErrorOnNoop is set.
+var ErrNothingToDo = errors.New("nothing to do")
+
+// Errors that describe common conditions. They are returned wrapped
+// with the version ID, so use errors.Is to test for them.
+var (
+	// ErrInvalidVersion means that the version is not defined in the schema.
+	ErrInvalidVersion = errors.New("invalid schema version")
+
+	// ErrVersionLocked means that a locked version prevents the migration.
+	ErrVersionLocked = errors.New("database schema version locked")
+
+	// ErrUnappliedVersion means that the version has not been applied
+	// to the database, so it cannot be forced.
+	ErrUnappliedVersion = errors.New("cannot force unapplied version")
+)
+
+// versionError wraps one of the sentinel errors with the version ID.
+type versionError struct {
+	Err error
+	ID  VersionID
+}
+
+func (e versionError) Error() string {
+	return fmt.Sprintf("%v id=%d", e.Err, e.ID)
+}
+
+func (e versionError) Unwrap() error {
+	return e.Err
+}
+
 // Errors describes one or more errors in the migration
 // schema definition. If the Schema.Err() method reports a
 // non-nil value, then it will be of type Errors.
@@ -104,15 +137,147 @@ func (e *Error) Error() string {
 	return fmt.Sprintf("%d: %s", e.Version, e.Description)
 }
 
+// FailedError is returned when a migration cannot proceed because a
+// previous migration failed. The failed version must be cleared, for
+// example by calling Worker.Force, before migrations can continue.
+type FailedError struct {
+	VersionID VersionID // First version that failed
+}
+
+// Error implements the error interface.
+func (e *FailedError) Error() string {
+	return fmt.Sprintf("version %d previously failed", e.VersionID)
+}
+
 // VersionID uniquely identifies a database schema version.
 type VersionID int64
 
 // Version provides information about a database schema version.
 type Version struct {
-	ID        VersionID  // Database schema version number
-	AppliedAt *time.Time // Time migration was applied, or nil if not applied
-	Failed    bool       // Did migration fail
-	Locked    bool       // Is version locked (prevent down migration)
-	Up        string     // SQL for up migration, or "<go-func>" if go function
-	Down      string     // SQL for down migration or "<go-func>"" if a go function
+	ID          VersionID     `json:"id"`                    // Database schema version number
+	Name        string        `json:"name,omitempty"`        // Name of the version, if defined in the schema
+	Applied     bool          `json:"applied"`               // Has the version been applied to the database
+	AppliedAt   *time.Time    `json:"applied_at"`            // Time migration was applied, or nil if not applied or not known
+	Failed      bool          `json:"failed"`                // Did migration fail
+	Locked      bool          `json:"locked"`                // Is version locked (prevent down migration)
+	Skipped     bool          `json:"skipped"`               // Was up migration skipped because it was not enabled
+	Environment string        `json:"environment,omitempty"` // Environment label of the worker that applied the migration
+	Warning     string        `json:"warning,omitempty"`     // Describes a problem with the version record, eg "applied_at is null"
+	Checksum    string        `json:"checksum,omitempty"`    // Checksum of the up migration when it was applied, if known
+	Duration    time.Duration `json:"duration,omitempty"`    // Time taken to perform the up migration, if known
+	AppliedBy   string        `json:"applied_by,omitempty"`  // Identity of the user that applied the migration, if known
+	Up          string        `json:"up,omitempty"`          // SQL for up migration, or "<go-func>" if go function
+	Down        string        `json:"down,omitempty"`        // SQL for down migration or "<go-func>"" if a go function
+}
+
+// Snapshot summarizes the state of the database schema versions.
+type Snapshot struct {
+	Version VersionID     // Highest applied version, or zero if none applied
+	Pending int           // Number of unapplied versions
+	Failed  int           // Number of failed versions
+	Locked  int           // Number of locked versions
+	Age     time.Duration // Time since the most recent migration was applied, or zero if none applied
+
+	LockedVersion VersionID // Highest locked version, or zero if none locked
+}
+
+// Summary describes the database schema version at the end of
+// an operation performed by a worker.
+type Summary struct {
+	Message string    // Describes the operation, eg "migrate up finished"
+	Version VersionID // Highest applied version, or zero if none applied
+	Locked  bool      // Is the highest applied version locked
+	Failed  bool      // Has the highest applied version failed
+
+	LockedCount int // Number of applied versions that are locked
+	FailedCount int // Number of applied versions that have failed
+}
+
+// Status is a brief summary of the state of the database, suitable
+// for use by a health check. It is derived from the Snapshot.
+type Status struct {
+	Current VersionID // Highest applied version, or zero if none applied
+	Pending int       // Number of versions in the schema not yet applied
+	Failed  bool      // Has any applied version failed
+	Locked  VersionID // Highest locked version, or zero if none locked
+}
+
+// PlannedStep describes a migration that will be performed.
+type PlannedStep struct {
+	ID        VersionID // Database schema version
+	Direction string    // Either "up" or "down"
+	SQL       string    // SQL for the migration, or "(TxFunc)" etc if a Go function
+}
+
+// Report compares the database schema versions applied to the database
+// with the versions defined in the schema. It is suitable for encoding
+// as JSON, for example by an HTTP handler.
+type Report struct {
+	Version    VersionID         `json:"version"`    // Highest applied version, or zero if none applied
+	Pending    []*ReportPending  `json:"pending"`    // Versions defined in the schema but not applied
+	Applied    []*ReportVersion  `json:"applied"`    // Versions applied to the database
+	Orphaned   []VersionID       `json:"orphaned"`   // Versions applied but not defined in the schema
+	Mismatches []*ReportMismatch `json:"mismatches"` // Versions modified since they were applied
+}
+
+// ReportVersion describes a version in a Report that has been applied
+// to the database.
+type ReportVersion struct {
+	ID        VersionID  `json:"id"`
+	AppliedAt *time.Time `json:"applied_at"`
+	Failed    bool       `json:"failed"`
+	Locked    bool       `json:"locked"`
+	Skipped   bool       `json:"skipped"`
+	Checksum  string     `json:"checksum,omitempty"`
+}
+
+// ReportPending describes a version in a Report that is defined
+// in the schema but has not been applied to the database.
+type ReportPending struct {
+	ID   VersionID `json:"id"`
+	Name string    `json:"name,omitempty"`
+}
+
+// ReportMismatch describes a version in a Report whose up migration
+// has been modified since it was applied to the database.
+type ReportMismatch struct {
+	ID       VersionID `json:"id"`
+	Applied  string    `json:"applied"`  // Checksum of the up migration when it was applied
+	Checksum string    `json:"checksum"` // Checksum of the up migration in the schema
+}
+
+// An Attestation is a signed statement of the database schema versions
+// applied to a database. Data is the canonical JSON representation of
+// the applied versions, and Signature is the signature of Data.
+type Attestation struct {
+	Data      []byte
+	Signature []byte
+}
+
+// ManifestEntry describes a version in a schema manifest. The checksums
+// are SHA-256 checksums of the SQL for each migration, or "go" if the
+// migration is implemented in Go. Kind is one of "sql", "go" or "replay".
+type ManifestEntry struct {
+	ID           VersionID `json:"id"`
+	UpChecksum   string    `json:"up_checksum"`
+	DownChecksum string    `json:"down_checksum"`
+	Kind         string    `json:"kind"`
+}
+
+// OrderAnomaly describes an applied version that was applied earlier
+// than a version with a lower id, which indicates that versions were
+// applied out of order, or that clocks were skewed.
+type OrderAnomaly struct {
+	ID             VersionID // Version applied out of order
+	AppliedAt      time.Time // Time that version ID was applied
+	LowerID        VersionID // Lower version applied after version ID
+	LowerAppliedAt time.Time // Time that version LowerID was applied
+}
+
+// RunResult describes the versions changed by a successful Up, Down
+// or Goto operation. It is passed to the worker's OnComplete function.
+type RunResult struct {
+	From    VersionID   // Highest applied version before the operation
+	To      VersionID   // Highest applied version after the operation
+	Changed []VersionID // Versions migrated up or down, in the order performed
 }
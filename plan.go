@@ -1,23 +1,35 @@
 package migration
 
 import (
+	"context"
+	"database/sql"
 	"fmt"
+	"time"
 )
 
 // a migrationPlan contains the information required to
 // migrate to a version from the previous version, and back
 // down again.
 type migrationPlan struct {
-	id   VersionID
-	up   action
-	down action
-	errs Errors
+	id      VersionID
+	name    string
+	up      action
+	down    action
+	enabled func(context.Context, *sql.DB) (bool, error)
+	meta    map[string]string
+	timeout time.Duration
+	replay  bool // up or down action replays an earlier version
+	errs    Errors
 }
 
 func newPlan(def *Definition, plans map[VersionID]*migrationPlan) *migrationPlan {
 	p := &migrationPlan{
-		id:   def.id,
-		errs: def.errs(),
+		id:      def.id,
+		name:    def.name,
+		enabled: def.enabled,
+		meta:    def.meta,
+		timeout: def.timeout,
+		errs:    def.errs(),
 	}
 
 	if def.upAction != nil {
@@ -34,24 +46,62 @@ func newPlan(def *Definition, plans map[VersionID]*migrationPlan) *migrationPlan
 		})
 	}
 
-	replayUp := func(a *action) {
-		if a.replayUp != nil {
-			replayID := *a.replayUp
-			if replayID >= p.id {
-				addError("replay must specify an earlier version")
-				return
-			}
-			prevPlan := plans[replayID]
-			if prevPlan == nil {
-				addError(fmt.Sprintf("replay refers to unknown version %d", replayID))
-			} else {
-				*a = prevPlan.up
-			}
+	// replay replaces an action that replays the up or down
+	// migration of an earlier version with that migration
+	replay := func(a *action) {
+		replayID, down := a.replayUp, false
+		if a.replayDown != nil {
+			replayID, down = a.replayDown, true
+		}
+		if replayID == nil {
+			return
+		}
+		p.replay = true
+		if *replayID >= p.id {
+			addError("replay must specify an earlier version")
+			return
+		}
+		prevPlan := plans[*replayID]
+		if prevPlan == nil {
+			addError(fmt.Sprintf("replay refers to unknown version %d", *replayID))
+		} else if down {
+			*a = prevPlan.down
+		} else {
+			*a = prevPlan.up
 		}
 	}
 
-	replayUp(&p.up)
-	replayUp(&p.down)
+	replay(&p.up)
+	replay(&p.down)
+
+	if def.external != nil {
+		if !p.up.isSQL() && !p.down.isSQL() {
+			addError("external apply requires an SQL migration")
+		}
+		for _, a := range []*action{&p.up, &p.down} {
+			if a.isSQL() {
+				a.external = def.external
+			}
+		}
+	}
 
 	return p
 }
+
+// actionContext returns the context in which to perform the up or
+// down migration, which is limited by the version's timeout, if any.
+func (p *migrationPlan) actionContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if p.timeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, p.timeout)
+}
+
+// timeoutErr returns err, annotated to show that the migration timed out
+// if actx, returned by actionContext, exceeded the version's timeout.
+func (p *migrationPlan) timeoutErr(ctx context.Context, actx context.Context, err error) error {
+	if p.timeout > 0 && ctx.Err() == nil && actx.Err() == context.DeadlineExceeded {
+		return wrapf(err, "timed out after %v", p.timeout)
+	}
+	return err
+}
@@ -1,7 +1,15 @@
 package migration
 
 import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
 	"sort"
+	"strings"
+	"time"
 )
 
 // A Schema contains all of the information required to perform database
@@ -15,11 +23,105 @@ type Schema struct {
 	// If not specified, defaults to the constant DefaultMigrationsTable.
 	MigrationsTable string
 
+	// MigrationsSchema optionally specifies the database schema that
+	// contains the migrations table, such as "infra" for postgres, the
+	// database name for mysql, or the name of an attached database for
+	// sqlite. The database schema must already exist. It is not used if
+	// the migrations table name is already qualified with a schema.
+	//
+	// The name must contain only letters, digits and underscores. As with
+	// MigrationsTable, the name is not quoted in SQL statements.
+	MigrationsSchema string
+
+	// Columns optionally specifies the names of the columns in the
+	// migrations table, for databases with naming standards that the
+	// default names do not meet.
+	Columns Columns
+
 	definitions map[VersionID]*Definition
 	plans       []*migrationPlan
+	checkpoint  *Checkpoint
+	seeds       []*seed
 	errs        Errors
 }
 
+// Columns specifies the names of the columns in the migrations table.
+// A blank name means the default name, which is shown in the comment
+// for each field. Names must contain only letters, digits and underscores,
+// and are not quoted in SQL statements.
+type Columns struct {
+	ID          string // id
+	AppliedAt   string // applied_at
+	Failed      string // failed
+	Locked      string // locked
+	Environment string // environment
+	Skipped     string // skipped
+	Checksum    string // checksum
+	DurationMS  string // duration_ms
+	AppliedBy   string // applied_by
+}
+
+// pairs returns each column placeholder, such as "{applied_at}",
+// followed by the name of the column. If c is nil the default
+// names are used.
+func (c *Columns) pairs() []string {
+	var cols Columns
+	if c != nil {
+		cols = *c
+	}
+	var pairs []string
+	for _, col := range []struct {
+		name string
+		def  string
+	}{
+		{cols.ID, "id"},
+		{cols.AppliedAt, "applied_at"},
+		{cols.Failed, "failed"},
+		{cols.Locked, "locked"},
+		{cols.Environment, "environment"},
+		{cols.Skipped, "skipped"},
+		{cols.Checksum, "checksum"},
+		{cols.DurationMS, "duration_ms"},
+		{cols.AppliedBy, "applied_by"},
+	} {
+		if col.name == "" {
+			col.name = col.def
+		}
+		pairs = append(pairs, "{"+col.def+"}", col.name)
+	}
+	return pairs
+}
+
+// expand replaces each column placeholder in s, such as "{applied_at}",
+// with the name of the column.
+func (c *Columns) expand(s string) string {
+	return strings.NewReplacer(c.pairs()...).Replace(s)
+}
+
+// role returns the default name of the column named column, or
+// a blank string if it is not one of the migrations table columns.
+// Names are compared without regard to case.
+func (c *Columns) role(column string) string {
+	pairs := c.pairs()
+	for i := 0; i < len(pairs); i += 2 {
+		if strings.EqualFold(pairs[i+1], column) {
+			return strings.Trim(pairs[i], "{}")
+		}
+	}
+	return ""
+}
+
+// check returns an error if any column name is not a valid identifier.
+func (c *Columns) check() error {
+	pairs := c.pairs()
+	for i := 1; i < len(pairs); i += 2 {
+		if !identifierRE.MatchString(pairs[i]) {
+			return fmt.Errorf("invalid migrations column name %q", pairs[i])
+		}
+	}
+	return nil
+}
+
 // Define a database schema version along with the migration up
 // from the previous version and the migration down to the
 // previous version.
@@ -46,6 +148,144 @@ func (s *Schema) Define(id VersionID) *Definition {
 	return d
 }
 
+// DefineLazy defines a database schema version whose definition is not
+// constructed until the schema is first used, for example by calling Err
+// or NewWorker. This reduces the cost of program initialization for large
+// schemas that are rarely migrated. The factory typically returns
+//  new(migration.Definition).Up(upSQL).Down(downSQL)
+//
+// A version id that is defined more than once is detected when DefineLazy
+// is called, but errors in the definition itself are not reported until
+// the factory has been called.
+func (s *Schema) DefineLazy(id VersionID, factory func() *Definition) {
+	s.Define(id).factory = factory
+}
+
+// Must panics if there are any errors in the migration schema definition.
+// The panic value is the error reported by Err, which is of type Errors.
+//
+// Must is intended to be called once all versions have been defined, so
+// that errors are reported at program startup. For example:
+//  func init() {
+//      defer schema.Must()
+//      schema.Define(1).Up(`create table t1(id int)`).Down(`drop table t1`)
+//  }
+func (s *Schema) Must() {
+	if err := s.Err(); err != nil {
+		panic(err)
+	}
+}
+
+// RequireStep reports an error for each defined version id that is
+// not a multiple of step. This is useful for schemas that number versions
+// in increments, such as 10, 20, 30, to leave room for later hotfixes.
+//
+// If RequireStep does report a non-nil value, it will be of type Errors.
+func (s *Schema) RequireStep(step VersionID) error {
+	if step <= 0 {
+		return fmt.Errorf("invalid step %d", step)
+	}
+	ids := make([]VersionID, 0, len(s.definitions))
+	for id := range s.definitions {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i] < ids[j]
+	})
+	var errs Errors
+	for _, id := range ids {
+		if id%step != 0 {
+			errs = append(errs, &Error{
+				Version:     id,
+				Description: fmt.Sprintf("not a multiple of %d", step),
+			})
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// Forbid reports an error for each SQL migration that contains any of
+// the forbidden statements, such as "DROP DATABASE" or "TRUNCATE". Matching
+// is case-insensitive, on whole words, and ignores SQL comments. Words in
+// a pattern match any amount of white space between them.
+//
+// If Forbid does report a non-nil value, it will be of type Errors.
+func (s *Schema) Forbid(patterns ...string) error {
+	s.complete()
+	forbidden := make([]*regexp.Regexp, 0, len(patterns))
+	for _, pattern := range patterns {
+		words := strings.Fields(pattern)
+		if len(words) == 0 {
+			return fmt.Errorf("invalid forbidden pattern %q", pattern)
+		}
+		for i, word := range words {
+			words[i] = regexp.QuoteMeta(word)
+		}
+		forbidden = append(forbidden, regexp.MustCompile(`(?i)\b`+strings.Join(words, `\s+`)+`\b`))
+	}
+	var errs Errors
+	for _, plan := range s.plans {
+		for _, a := range []struct {
+			direction string
+			action    *action
+		}{
+			{"up", &plan.up},
+			{"down", &plan.down},
+		} {
+			if !a.action.isSQL() {
+				continue
+			}
+			query := stripComments(a.action.sql)
+			for i, re := range forbidden {
+				if re.MatchString(query) {
+					errs = append(errs, &Error{
+						Version:     plan.id,
+						Description: fmt.Sprintf("%s: forbidden statement %s", a.direction, patterns[i]),
+					})
+				}
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+var sqlCommentRE = regexp.MustCompile(`(?s)--[^\n]*|/\*.*?\*/`)
+
+// stripComments removes SQL comments from query.
+func stripComments(query string) string {
+	return sqlCommentRE.ReplaceAllString(query, " ")
+}
+
+// NextID returns the next unused version id, which is one more than
+// the highest defined version id, or 1 if no versions are defined.
+func (s *Schema) NextID() VersionID {
+	var id VersionID
+	for defined := range s.definitions {
+		if defined > id {
+			id = defined
+		}
+	}
+	return id + 1
+}
+
+// NextTimestampID returns a version id based on the current UTC time
+// in the format YYYYMMDDHHMMSS. This is useful for schemas that use
+// timestamps for version ids.
+func (s *Schema) NextTimestampID() VersionID {
+	t := time.Now().UTC()
+	id := int64(t.Year())
+	for _, n := range []int{int(t.Month()), t.Day(), t.Hour(), t.Minute(), t.Second()} {
+		id = id*100 + int64(n)
+	}
+	return VersionID(id)
+}
+
 // Err reports a non-nil error if there are any errors in the
 // migration schema definition, otherwise it returns nil.
 //
@@ -59,6 +299,9 @@ func (s *Schema) Define(id VersionID) *Definition {
 //          t.Fatal(err)
 //      }
 //  }
+//
+// Problems that do not prevent migrations from being performed are not
+// reported by Err. See Warnings.
 func (s *Schema) Err() error {
 	s.complete()
 	var errs Errors
@@ -66,12 +309,147 @@ func (s *Schema) Err() error {
 	for _, p := range s.plans {
 		errs = append(errs, p.errs...)
 	}
+	if s.checkpoint != nil {
+		errs = append(errs, s.checkpoint.errs(s)...)
+	}
 	if len(errs) > 0 {
 		return errs
 	}
 	return nil
 }
 
+// Warnings reports problems in the migration schema definition that
+// are likely to be mistakes, but do not prevent migrations from being
+// performed, such as an empty down migration, or an up migration with
+// the same SQL as an earlier version. Unlike errors reported by Err,
+// warnings do not prevent a worker from being created.
+func (s *Schema) Warnings() Errors {
+	s.complete()
+	var warnings Errors
+	addWarning := func(id VersionID, desc string) {
+		warnings = append(warnings, &Error{
+			Version:     id,
+			Description: desc,
+		})
+	}
+	upSQL := make(map[string]VersionID)
+	for _, p := range s.plans {
+		if p.down.isSQL() && strings.TrimSpace(p.down.sql) == "" {
+			addWarning(p.id, "down migration is empty")
+		}
+		if p.replay || !p.up.isSQL() {
+			continue
+		}
+		query := strings.TrimSpace(p.up.sql)
+		if id, ok := upSQL[query]; ok {
+			addWarning(p.id, fmt.Sprintf("up migration is the same as version %d", id))
+		} else {
+			upSQL[query] = p.id
+		}
+	}
+	return warnings
+}
+
+// Export writes the SQL migrations for each database schema version
+// to w in JSON format. Replay actions are resolved to the SQL of the
+// version being replayed.
+//
+// Export reports an error if the schema definition has errors, or if
+// any migration is implemented using Go code.
+func (s *Schema) Export(w io.Writer) error {
+	if err := s.Err(); err != nil {
+		return err
+	}
+
+	type exportVersion struct {
+		ID   VersionID `json:"id"`
+		Up   string    `json:"up"`
+		Down string    `json:"down"`
+	}
+
+	versions := make([]exportVersion, 0, len(s.plans))
+	for _, p := range s.plans {
+		if !p.up.isSQL() || !p.down.isSQL() {
+			return fmt.Errorf("cannot export version %d: migration is not SQL", p.id)
+		}
+		versions = append(versions, exportVersion{
+			ID:   p.id,
+			Up:   p.up.sql,
+			Down: p.down.sql,
+		})
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(versions)
+}
+
+// Manifest returns an entry for each version in the schema, in version
+// order, with checksums of its up and down migrations. A manifest can be
+// committed to source control, and compared with the manifest of a later
+// build to detect changes to migrations that have already been released.
+func (s *Schema) Manifest() ([]ManifestEntry, error) {
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	entries := make([]ManifestEntry, 0, len(s.plans))
+	for _, p := range s.plans {
+		kind := "sql"
+		if p.replay {
+			kind = "replay"
+		} else if !p.up.isSQL() || !p.down.isSQL() {
+			kind = "go"
+		}
+		entries = append(entries, ManifestEntry{
+			ID:           p.id,
+			UpChecksum:   p.up.checksum(),
+			DownChecksum: p.down.checksum(),
+			Kind:         kind,
+		})
+	}
+	return entries, nil
+}
+
+// ApplyTx performs all of the up migrations in the schema using the
+// transaction, without committing it and without recording the versions
+// in the migrations table. The driverName is the name of the database/sql
+// driver, as registered with RegisterDriverForName.
+//
+// ApplyTx is intended for test suites that run each test in a transaction
+// that is rolled back, so that the migrations are undone automatically.
+// It reports an error if the database does not support transactional DDL,
+// or if any up migration cannot be performed in a transaction, such as
+// a migration implemented using DBFunc.
+func (s *Schema) ApplyTx(ctx context.Context, tx *sql.Tx, driverName string) error {
+	if err := s.Err(); err != nil {
+		return err
+	}
+	drv, err := findNamedDriver(driverName)
+	if err != nil {
+		return err
+	}
+	if !drv.SupportsTransactionalDDL() {
+		return fmt.Errorf("cannot apply migrations in a transaction: %s does not support transactional DDL", drv.Dialect())
+	}
+	for _, plan := range s.plans {
+		up := plan.up
+		if plan.enabled != nil || up.dbFunc != nil || up.batch != nil || up.external != nil {
+			return fmt.Errorf("cannot apply version %d in a transaction", plan.id)
+		}
+	}
+	for _, plan := range s.plans {
+		if up := plan.up; up.txFunc != nil {
+			err = up.txFunc(ctx, tx)
+		} else {
+			_, err = tx.ExecContext(ctx, up.sql)
+		}
+		if err != nil {
+			return wrapf(err, "%d", plan.id)
+		}
+	}
+	return nil
+}
+
 func (s *Schema) complete() {
 	if s.plans != nil {
 		// already complete
@@ -94,6 +472,15 @@ func (s *Schema) complete() {
 	plans := make(map[VersionID]*migrationPlan)
 	for _, id := range ids {
 		d := s.definitions[id]
+		if d.factory != nil {
+			if ld := d.factory(); ld != nil {
+				ld.id = id
+				d = ld
+			} else {
+				d = newDefinition(id)
+			}
+			s.definitions[id] = d
+		}
 		p := newPlan(d, plans)
 		s.plans = append(s.plans, p)
 		plans[id] = p
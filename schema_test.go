@@ -1,13 +1,92 @@
 package migration
 
 import (
+	"bytes"
 	"context"
 	"database/sql"
+	"encoding/json"
+	"fmt"
 	"reflect"
 	"strings"
 	"testing"
+	"time"
 )
 
+func TestApplyTx(t *testing.T) {
+	ctx := context.Background()
+	db, err := sql.Open("sqlite3", ":memory:")
+	wantNoError(t, err)
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	var schema Schema
+	schema.Define(1).Up("create table t1(id int)").Down("drop table t1")
+	schema.Define(2).UpAction(TxFunc(func(ctx context.Context, tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, "insert into t1(id) values(1)")
+		return err
+	})).Down("delete from t1")
+
+	tx, err := db.BeginTx(ctx, nil)
+	wantNoError(t, err)
+	wantNoError(t, schema.ApplyTx(ctx, tx, "sqlite3"))
+	var count int
+	wantNoError(t, tx.QueryRowContext(ctx, "select count(*) from t1").Scan(&count))
+	if got, want := count, 1; got != want {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+	wantNoError(t, tx.Rollback())
+
+	_, err = db.ExecContext(ctx, "select count(*) from t1")
+	wantError(t, err, "no such table")
+	_, err = db.ExecContext(ctx, "select count(*) from schema_migrations")
+	wantError(t, err, "no such table")
+
+	schema.Define(3).
+		UpAction(DBFunc(func(context.Context, *sql.DB) error { return nil })).
+		Down("select 1")
+	tx, err = db.BeginTx(ctx, nil)
+	wantNoError(t, err)
+	defer tx.Rollback()
+	wantError(t, schema.ApplyTx(ctx, tx, "sqlite3"), "cannot apply version 3 in a transaction")
+}
+
+func TestForbid(t *testing.T) {
+	var schema Schema
+	schema.Define(1).
+		Up("create table truncate_log(id int); -- truncate is not used").
+		Down("drop table truncate_log")
+	schema.Define(2).
+		Up("/* clean up */ TRUNCATE\ttruncate_log").
+		Down("select 1")
+	schema.Define(3).
+		Up("select 1").
+		Down("drop   database test")
+
+	err := schema.Forbid("DROP DATABASE", "GRANT", "TRUNCATE")
+	if err == nil {
+		t.Fatal("got=nil, want=error")
+	}
+	errs, ok := err.(Errors)
+	if !ok {
+		t.Fatalf("got=%T, want=Errors", err)
+	}
+	var got []string
+	for _, e := range errs {
+		got = append(got, fmt.Sprintf("%d: %s", e.Version, e.Description))
+	}
+	want := []string{
+		"2: up: forbidden statement TRUNCATE",
+		"3: down: forbidden statement DROP DATABASE",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+
+	wantNoError(t, schema.Forbid("GRANT"))
+	wantError(t, schema.Forbid("GRANT", ""), `invalid forbidden pattern ""`)
+	wantError(t, schema.Forbid(" \t"), "invalid forbidden pattern")
+}
+
 func TestSchemaErrors(t *testing.T) {
 	tests := []struct {
 		fn   func(s *Schema)
@@ -110,6 +189,16 @@ func TestSchemaErrors(t *testing.T) {
 				"9: replay must specify an earlier version",
 			},
 		},
+		{
+			fn: func(s *Schema) {
+				s.Define(9).UpAction(ReplayDown(8)).Down(`-- noop`)
+				s.Define(10).UpAction(ReplayDown(10)).Down(`-- noop`)
+			},
+			errs: []string{
+				"9: replay refers to unknown version 8",
+				"10: replay must specify an earlier version",
+			},
+		},
 	}
 
 	for tn, tt := range tests {
@@ -167,6 +256,15 @@ func TestSchemaReplay(t *testing.T) {
 			},
 			want: "create view v1;",
 		},
+		{
+			fn: func(s *Schema) string {
+				s.Define(1).Up("create view v1;").Down("drop view v1;")
+				s.Define(2).UpAction(ReplayDown(1)).DownAction(Replay(1))
+				s.complete()
+				return s.plans[1].up.sql
+			},
+			want: "drop view v1;",
+		},
 	}
 	for tn, tt := range tests {
 		var s Schema
@@ -181,3 +279,217 @@ func TestSchemaReplay(t *testing.T) {
 		}
 	}
 }
+
+func TestSchemaExport(t *testing.T) {
+	var s1 Schema
+	s1.Define(1).Up("create view v1;").Down("drop view v1;")
+	s1.Define(2).Up("drop view v1;").DownAction(Replay(1))
+
+	var buf bytes.Buffer
+	if err := s1.Export(&buf); err != nil {
+		t.Fatal(err)
+	}
+	exported := buf.String()
+
+	var versions []struct {
+		ID   VersionID
+		Up   string
+		Down string
+	}
+	if err := json.Unmarshal(buf.Bytes(), &versions); err != nil {
+		t.Fatal(err)
+	}
+	var s2 Schema
+	for _, v := range versions {
+		s2.Define(v.ID).Up(v.Up).Down(v.Down)
+	}
+	buf.Reset()
+	if err := s2.Export(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := buf.String(), exported; got != want {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+	if got, want := s2.plans[1].down.sql, "create view v1;"; got != want {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+
+	var s3 Schema
+	s3.Define(1).Up("create table t1;").DownAction(TxFunc(func(ctx context.Context, tx *sql.Tx) error { return nil }))
+	err := s3.Export(&buf)
+	if got, want := fmt.Sprint(err), "cannot export version 1: migration is not SQL"; got != want {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+}
+
+func TestSchemaNextID(t *testing.T) {
+	var s Schema
+	if got, want := s.NextID(), VersionID(1); got != want {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+
+	// same version ids as the package example
+	for id := VersionID(1); id <= 6; id++ {
+		s.Define(id).Up("-- up").Down("-- down")
+	}
+	if got, want := s.NextID(), VersionID(7); got != want {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+
+	before := time.Now().UTC().Format("20060102150405")
+	id := s.NextTimestampID()
+	after := time.Now().UTC().Format("20060102150405")
+	if got := fmt.Sprint(id); got < before || got > after {
+		t.Errorf("got=%v, want between %v and %v", got, before, after)
+	}
+}
+
+func TestSchemaMust(t *testing.T) {
+	must := func(s *Schema) (r interface{}) {
+		defer func() {
+			r = recover()
+		}()
+		s.Must()
+		return nil
+	}
+
+	var s1 Schema
+	s1.Define(1).Up("create table t1(id int);").Down("drop table t1;")
+	if r := must(&s1); r != nil {
+		t.Errorf("got=%v, want=nil", r)
+	}
+
+	var s2 Schema
+	s2.Define(1).Up("create table t1(id int);").Down("drop table t1;")
+	s2.Define(1).Up("create table t1(id int);").Down("drop table t1;")
+	r := must(&s2)
+	if _, ok := r.(Errors); !ok {
+		t.Fatalf("got=%T, want=Errors", r)
+	}
+	if got, want := r.(error).Error(), "1: defined more than once"; got != want {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+}
+
+func TestSchemaDefineLazy(t *testing.T) {
+	var calls int
+	var schema Schema
+	schema.DefineLazy(1, func() *Definition {
+		calls++
+		return new(Definition).Up("create table t1(id int);").Down("drop table t1;")
+	})
+	schema.DefineLazy(2, func() *Definition {
+		calls++
+		return new(Definition).Up("create table t2(id int);")
+	})
+	schema.Define(1).Up("create table t1(id int);").Down("drop table t1;")
+	if got, want := calls, 0; got != want {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+	if got, want := schema.errs.Error(), "1: defined more than once"; got != want {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+
+	err := schema.Err()
+	if got, want := calls, 2; got != want {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+	if got, want := err.Error(), "1: defined more than once\n2: down migration not defined"; got != want {
+		t.Errorf("got=%q, want=%q", got, want)
+	}
+
+	// factories are only called once
+	schema.Err()
+	if got, want := calls, 2; got != want {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+}
+
+func TestSchemaManifest(t *testing.T) {
+	newSchema := func(up2 string) *Schema {
+		var schema Schema
+		schema.Define(1).Up("create view v1 as select 1;").Down("drop view v1;")
+		schema.Define(2).Up(up2).Down("drop table t2;")
+		schema.Define(3).UpAction(Replay(1)).Down("drop view v1;")
+		schema.Define(4).UpAction(TxFunc(func(context.Context, *sql.Tx) error {
+			return nil
+		})).Down("select 1;")
+		return &schema
+	}
+	kinds := func(entries []ManifestEntry) []string {
+		var kinds []string
+		for _, e := range entries {
+			kinds = append(kinds, fmt.Sprintf("%d:%s", e.ID, e.Kind))
+		}
+		return kinds
+	}
+
+	m1, err := newSchema("create table t2(id int);").Manifest()
+	wantNoError(t, err)
+	if got, want := kinds(m1), []string{"1:sql", "2:sql", "3:replay", "4:go"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+	if got, want := m1[3].UpChecksum, "go"; got != want {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+
+	m2, err := newSchema("create table t2(id int);").Manifest()
+	wantNoError(t, err)
+	if !reflect.DeepEqual(m1, m2) {
+		t.Errorf("got=%+v, want=%+v", m2, m1)
+	}
+
+	m3, err := newSchema("create table t2(id int, name text);").Manifest()
+	wantNoError(t, err)
+	for i := range m1 {
+		if got, want := m1[i] == m3[i], m1[i].ID != 2; got != want {
+			t.Errorf("%d: got=%v, want=%v", m1[i].ID, got, want)
+		}
+	}
+}
+
+func TestSchemaWarnings(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	wantNoError(t, err)
+	defer db.Close()
+
+	var schema Schema
+	schema.Define(1).Up("create view v1 as select 1;").Down("drop view v1;")
+	schema.Define(2).Up("create table t2(id int);").Down("  ")
+	schema.Define(3).Up("create view v1 as select 1;").Down("drop view v1;")
+	schema.Define(4).UpAction(Replay(1)).Down("drop view v1;")
+	wantNoError(t, schema.Err())
+
+	_, err = NewWorker(db, &schema)
+	wantNoError(t, err)
+	want := "2: down migration is empty\n3: up migration is the same as version 1"
+	if got := schema.Warnings(); got == nil || got.Error() != want {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+
+	var clean Schema
+	clean.Define(1).Up("create table t1(id int);").Down("drop table t1;")
+	if got := clean.Warnings(); got != nil {
+		t.Errorf("got=%v, want=nil", got)
+	}
+}
+
+func TestSchemaRequireStep(t *testing.T) {
+	var s Schema
+	for _, id := range []VersionID{10, 20, 25, 30} {
+		s.Define(id).Up("-- up").Down("-- down")
+	}
+	if err := s.RequireStep(5); err != nil {
+		t.Errorf("got=%v, want=nil", err)
+	}
+	err := s.RequireStep(10)
+	if _, ok := err.(Errors); !ok {
+		t.Fatalf("got=%T, want=Errors", err)
+	}
+	if got, want := err.Error(), "25: not a multiple of 10"; got != want {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+	if err = s.RequireStep(0); err == nil {
+		t.Error("got=nil, want=error")
+	}
+}
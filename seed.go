@@ -0,0 +1,145 @@
+package migration
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// seed loads reference data, and is performed by the worker's Seed method.
+type seed struct {
+	name   string
+	action action
+}
+
+// Seed defines an action, identified by name, that loads reference data
+// into the database. Seeds are not versions: they have no down migration,
+// and they are performed by the worker's Seed method after the database
+// has been migrated up. Each seed is performed once, in the order that
+// the seeds are defined, and is recorded by name in its own table so that
+// it is not performed again.
+//
+// Seeds can be defined using Command, TxFunc or DBFunc. Command and TxFunc
+// seeds are performed in the same transaction that records them.
+func (s *Schema) Seed(name string, act Action) {
+	addError := func(desc string) {
+		s.errs = append(s.errs, &Error{
+			Description: fmt.Sprintf("seed %q %s", name, desc),
+		})
+	}
+	if name == "" {
+		addError("has no name")
+		return
+	}
+	for _, sd := range s.seeds {
+		if sd.name == name {
+			addError("defined more than once")
+			return
+		}
+	}
+	sd := &seed{name: name}
+	if act != nil {
+		act(&sd.action)
+	}
+	a := &sd.action
+	if act == nil || a.batch != nil || a.replayUp != nil || a.replayDown != nil {
+		addError("must be defined using Command, TxFunc or DBFunc")
+		return
+	}
+	s.seeds = append(s.seeds, sd)
+}
+
+// Seed performs the seeds defined in the schema that have not already been
+// performed on the database, in the order that they were defined. The
+// database must be up to date, so Seed is normally called after Up. Calling
+// Seed again does nothing for seeds that have already been performed.
+func (m *Worker) Seed(ctx context.Context) error {
+	if err := checkContext(ctx, "seed"); err != nil {
+		return err
+	}
+	release, err := m.advisoryLock(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+	if err = m.init(ctx); err != nil {
+		return err
+	}
+	err = m.transact(ctx, func(tx *sql.Tx) error {
+		vs, err := m.getVersionSummary(ctx, tx)
+		if err != nil {
+			return err
+		}
+		if n := len(vs.unapplied); n > 0 {
+			return fmt.Errorf("cannot seed: database has %d pending migrations", n)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if err = m.drv.CreateSeedsTable(ctx, m.db, m.seedsTableName(ctx)); err != nil {
+		return err
+	}
+	for _, sd := range m.schema.seeds {
+		applied, err := m.seedOne(ctx, sd)
+		if err != nil {
+			return err
+		}
+		if applied {
+			m.log(fmt.Sprintf("seeded name=%s", sd.name))
+		}
+	}
+	m.finished(ctx, "seed finished")
+	return nil
+}
+
+// seedOne performs seed sd if it has not already been performed,
+// and reports whether it was performed.
+func (m *Worker) seedOne(ctx context.Context, sd *seed) (applied bool, err error) {
+	tblname := m.seedsTableName(ctx)
+	a := &sd.action
+	if a.dbFunc == nil {
+		err = m.transact(ctx, func(tx *sql.Tx) error {
+			// reset in case the transaction is retried
+			applied = false
+			done, err := m.drv.SeedApplied(ctx, tx, tblname, sd.name)
+			if err != nil || done {
+				return err
+			}
+			if a.txFunc != nil {
+				err = a.txFunc(ctx, tx)
+			} else {
+				err = m.execSQL(ctx, tx, a.sql)
+			}
+			if err != nil {
+				return wrapf(err, "seed %s", sd.name)
+			}
+			applied = true
+			return m.drv.InsertSeed(ctx, tx, tblname, sd.name, time.Now())
+		})
+		return applied, err
+	}
+
+	// performed outside of a transaction
+	var done bool
+	err = m.transact(ctx, func(tx *sql.Tx) error {
+		var err error
+		done, err = m.drv.SeedApplied(ctx, tx, tblname, sd.name)
+		return err
+	})
+	if err != nil || done {
+		return false, err
+	}
+	if err = a.dbFunc(ctx, m.db); err != nil {
+		return false, wrapf(err, "seed %s", sd.name)
+	}
+	err = m.transact(ctx, func(tx *sql.Tx) error {
+		return m.drv.InsertSeed(ctx, tx, tblname, sd.name, time.Now())
+	})
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
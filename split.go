@@ -0,0 +1,89 @@
+package migration
+
+import (
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// dollarTagRE matches the opening tag of a PostgreSQL dollar-quoted string.
+var dollarTagRE = regexp.MustCompile(`^\$([A-Za-z_][A-Za-z0-9_]*)?\$`)
+
+// splitStatements splits SQL into individual statements at each semicolon
+// that is not inside a quoted string, a quoted identifier, a dollar-quoted
+// string or a comment. The terminating semicolons are not included, and
+// statements that contain only white space and comments are omitted.
+//
+// A backslash escapes the next character in a single-quoted string, as
+// it does for MySQL.
+func splitStatements(sql string) []string {
+	var (
+		stmts   []string
+		start   int
+		hasCode bool // current statement has more than space and comments
+	)
+	for i := 0; i < len(sql); i++ {
+		c := sql[i]
+		switch {
+		case c == '\'' || c == '"' || c == '`':
+			i = skipQuoted(sql, i)
+			hasCode = true
+		case strings.HasPrefix(sql[i:], "--"):
+			if n := strings.IndexByte(sql[i:], '\n'); n >= 0 {
+				i += n
+			} else {
+				i = len(sql)
+			}
+		case strings.HasPrefix(sql[i:], "/*"):
+			if n := strings.Index(sql[i+2:], "*/"); n >= 0 {
+				i += n + 3
+			} else {
+				i = len(sql)
+			}
+		case c == '$':
+			if tag := dollarTagRE.FindString(sql[i:]); tag != "" {
+				body := i + len(tag)
+				if n := strings.Index(sql[body:], tag); n >= 0 {
+					i = body + n + len(tag) - 1
+				} else {
+					i = len(sql)
+				}
+			}
+			hasCode = true
+		case c == ';':
+			if hasCode {
+				stmts = append(stmts, strings.TrimSpace(sql[start:i]))
+			}
+			start = i + 1
+			hasCode = false
+		case !unicode.IsSpace(rune(c)):
+			hasCode = true
+		}
+	}
+	if hasCode {
+		stmts = append(stmts, strings.TrimSpace(sql[start:]))
+	}
+	return stmts
+}
+
+// skipQuoted returns the index of the quote that closes the quoted string
+// or identifier starting at sql[i], or len(sql) if it is not closed. A
+// doubled quote character does not close the string.
+func skipQuoted(sql string, i int) int {
+	quote := sql[i]
+	for j := i + 1; j < len(sql); j++ {
+		switch sql[j] {
+		case '\\':
+			if quote == '\'' {
+				j++
+			}
+		case quote:
+			if j+1 < len(sql) && sql[j+1] == quote {
+				j++
+				continue
+			}
+			return j
+		}
+	}
+	return len(sql)
+}
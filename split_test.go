@@ -0,0 +1,55 @@
+package migration
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitStatements(t *testing.T) {
+	tests := []struct {
+		sql  string
+		want []string
+	}{
+		{
+			sql:  "",
+			want: nil,
+		},
+		{
+			sql:  "create table t1(id int)",
+			want: []string{"create table t1(id int)"},
+		},
+		{
+			sql:  "create table t1(id int);\ncreate index t1_ix on t1(id);\n",
+			want: []string{"create table t1(id int)", "create index t1_ix on t1(id)"},
+		},
+		{
+			sql:  "insert into t1 values('a;b', 'it''s;', 'c\\';d');select 1",
+			want: []string{"insert into t1 values('a;b', 'it''s;', 'c\\';d')", "select 1"},
+		},
+		{
+			sql:  "select \"a;b\", `c;d` from t1;",
+			want: []string{"select \"a;b\", `c;d` from t1"},
+		},
+		{
+			sql:  "-- comment; with semicolon\nselect 1; /* block; comment */ select 2;\n-- trailing comment",
+			want: []string{"-- comment; with semicolon\nselect 1", "/* block; comment */ select 2"},
+		},
+		{
+			sql:  "create function f() returns int as $$ select 1; $$ language sql; select $1",
+			want: []string{"create function f() returns int as $$ select 1; $$ language sql", "select $1"},
+		},
+		{
+			sql:  "select $tag$ a; $$ b; $tag$;;  ;",
+			want: []string{"select $tag$ a; $$ b; $tag$"},
+		},
+		{
+			sql:  "select 'unterminated; string",
+			want: []string{"select 'unterminated; string"},
+		},
+	}
+	for tn, tt := range tests {
+		if got := splitStatements(tt.sql); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%d: got=%q, want=%q", tn, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package migration
+
+import (
+	"context"
+	"database/sql"
+)
+
+// A StateStore records which database schema versions have been applied.
+// By default, a worker stores this state in a migrations table in the
+// database being migrated. Assign a StateStore to the worker to keep
+// the state elsewhere, such as in a central service.
+//
+// Each method is passed the transaction in which the worker is operating.
+// A StateStore that does not keep its state in the database can ignore it.
+type StateStore interface {
+	ListVersions(ctx context.Context, tx *sql.Tx) ([]*Version, error)
+	InsertVersion(ctx context.Context, tx *sql.Tx, ver *Version) error
+	DeleteVersion(ctx context.Context, tx *sql.Tx, id VersionID) error
+	SetFailed(ctx context.Context, tx *sql.Tx, id VersionID, failed bool) error
+	SetLocked(ctx context.Context, tx *sql.Tx, id VersionID, locked bool) error
+}
+
+// ReadVersions reads the database schema versions recorded in the
+// migrations table. If tableName is blank, DefaultMigrationsTable is used.
+//
+// Unlike the worker's Versions method, ReadVersions does not require the
+// migration schema, so it is useful for tools that only need to report
+// the state of a database. Only versions that have been applied to the
+// database are returned. The migrations table must have the default
+// column names.
+func ReadVersions(ctx context.Context, db *sql.DB, tableName string) ([]*Version, error) {
+	drv, err := findDriver(db)
+	if err != nil {
+		return nil, err
+	}
+	if tableName == "" {
+		tableName = DefaultMigrationsTable
+	}
+	tx, err := db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return nil, wrapf(err, "cannot begin tx")
+	}
+	// read-only, so nothing to commit
+	defer tx.Rollback()
+	return drv.ListVersions(ctx, tx, tableName, nil)
+}
+
+// tableStore is the default StateStore, which keeps state in
+// the migrations table.
+type tableStore struct {
+	drv     Driver
+	tblname string
+	cols    *Columns
+}
+
+func (s *tableStore) ListVersions(ctx context.Context, tx *sql.Tx) ([]*Version, error) {
+	return s.drv.ListVersions(ctx, tx, s.tblname, s.cols)
+}
+
+func (s *tableStore) InsertVersion(ctx context.Context, tx *sql.Tx, ver *Version) error {
+	return s.drv.InsertVersion(ctx, tx, s.tblname, s.cols, ver)
+}
+
+func (s *tableStore) DeleteVersion(ctx context.Context, tx *sql.Tx, id VersionID) error {
+	return s.drv.DeleteVersion(ctx, tx, s.tblname, s.cols, id)
+}
+
+func (s *tableStore) SetFailed(ctx context.Context, tx *sql.Tx, id VersionID, failed bool) error {
+	return s.drv.SetVersionFailed(ctx, tx, s.tblname, s.cols, id, failed)
+}
+
+func (s *tableStore) SetLocked(ctx context.Context, tx *sql.Tx, id VersionID, locked bool) error {
+	return s.drv.SetVersionLocked(ctx, tx, s.tblname, s.cols, id, locked)
+}
@@ -0,0 +1,57 @@
+package migration
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// PrepareTemplate migrates the database up to the latest version and then
+// marks it as a template database, which can be cloned using
+// CloneFromTemplate. The worker's database must be the template database,
+// and templateName must be its name.
+//
+// Cloning a migrated template database is much faster than migrating a new
+// database, which makes it useful for setting up databases in test suites.
+// This is only supported for PostgreSQL.
+func (m *Worker) PrepareTemplate(ctx context.Context, templateName string) error {
+	if m.drv.Dialect() != "postgres" {
+		return fmt.Errorf("template databases not supported for %s", m.drv.Dialect())
+	}
+	if err := m.Up(ctx); err != nil {
+		return err
+	}
+	query := fmt.Sprintf("alter database %s with is_template true", quoteIdent(templateName))
+	if _, err := m.db.ExecContext(ctx, query); err != nil {
+		return wrapf(err, "cannot mark database %s as template", templateName)
+	}
+	m.log(fmt.Sprintf("prepared template database=%s", templateName))
+	return nil
+}
+
+// CloneFromTemplate creates a new database named newName as a copy of
+// the template database prepared by PrepareTemplate. The admin database
+// is any database on the same server other than the template database,
+// and there must be no other connections to the template database.
+//
+// This is only supported for PostgreSQL.
+func CloneFromTemplate(ctx context.Context, admin *sql.DB, templateName, newName string) error {
+	drv, err := findDriver(admin)
+	if err != nil {
+		return err
+	}
+	if drv.Dialect() != "postgres" {
+		return fmt.Errorf("template databases not supported for %s", drv.Dialect())
+	}
+	query := fmt.Sprintf("create database %s template %s", quoteIdent(newName), quoteIdent(templateName))
+	if _, err := admin.ExecContext(ctx, query); err != nil {
+		return wrapf(err, "cannot create database %s from template %s", newName, templateName)
+	}
+	return nil
+}
+
+// quoteIdent quotes an SQL identifier using double quotes.
+func quoteIdent(name string) string {
+	return `"` + strings.Replace(name, `"`, `""`, -1) + `"`
+}
@@ -0,0 +1,70 @@
+package migration
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+)
+
+// VerifyAllDrivers checks that every up and down migration in the schema
+// can be performed on each of the databases in dsns, which maps a
+// database/sql driver name to a data source name. For each database,
+// all up migrations are performed, followed by all down migrations,
+// after which no versions should remain applied. Drivers with an
+// empty data source name are skipped.
+//
+// VerifyAllDrivers is intended for use in CI, where it catches down
+// migrations that work for one database but not another. Each database
+// should be empty, as it is migrated to version zero at the end.
+func VerifyAllDrivers(ctx context.Context, schema *Schema, dsns map[string]string) error {
+	names := make([]string, 0, len(dsns))
+	for name, dsn := range dsns {
+		if dsn != "" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if err := verifyDriver(ctx, schema, name, dsns[name]); err != nil {
+			return wrapf(err, "%s", name)
+		}
+	}
+	return nil
+}
+
+func verifyDriver(ctx context.Context, schema *Schema, driverName, dsn string) error {
+	db, err := sql.Open(driverName, dsn)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	worker, err := NewWorkerNamed(db, schema, driverName)
+	if err != nil {
+		return err
+	}
+	if worker.drv.Dialect() == "sqlite" {
+		// sqlite in-memory databases exist only for the life of a
+		// connection. Other drivers hold the advisory lock on a
+		// dedicated connection, so they need more than one.
+		db.SetMaxOpenConns(1)
+	}
+	if err = worker.Up(ctx); err != nil {
+		return err
+	}
+	if err = worker.Goto(ctx, 0); err != nil {
+		return err
+	}
+	versions, err := worker.Versions(ctx)
+	if err != nil {
+		return err
+	}
+	for _, ver := range versions {
+		if ver.Applied {
+			return fmt.Errorf("version %d still applied after migrating down", ver.ID)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,31 @@
+package migration_test
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/jjeffery/migration"
+)
+
+func ExampleVerifyAllDrivers() {
+	var schema migration.Schema
+	schema.Define(1).
+		Up(`create table verify_t1(id integer primary key, name text)`).
+		Down(`drop table verify_t1`)
+	schema.Define(2).
+		Up(`create table verify_t2(id integer primary key, t1_id integer)`).
+		Down(`drop table verify_t2`)
+
+	// Databases without a data source name are skipped, so CI can
+	// enable postgres and mysql by setting environment variables.
+	err := migration.VerifyAllDrivers(context.Background(), &schema, map[string]string{
+		"sqlite3":  ":memory:",
+		"postgres": os.Getenv("MIGRATION_TEST_POSTGRES"),
+		"mysql":    os.Getenv("MIGRATION_TEST_MYSQL"),
+	})
+	fmt.Println("error:", err)
+
+	// Output:
+	// error: <nil>
+}
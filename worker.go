@@ -3,15 +3,30 @@ package migration
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"os/user"
+	"regexp"
 	"sort"
+	"strings"
 	"time"
 )
 
 // A Worker performs database migrations. It combines the
 // information in the migration schema along with the database
 // on which to perform migrations.
+//
+// Operations that change the migrations table, such as Up, Down, Goto,
+// Force and Lock, hold a database advisory lock while they run, so that
+// concurrent workers migrating the same database are serialized. The lock
+// is acquired before the migrations table is created. For postgres, mysql
+// and sqlserver the lock is held on a dedicated connection, so the database
+// must allow at least two open connections. SQLite has no advisory locks:
+// instead, pragma busy_timeout is set on one of the pooled connections, so
+// that a worker waits for the database lock held by another. CockroachDB
+// and Oracle have no lock.
 type Worker struct {
 	// LogFunc is a function for logging progress. If not specified then
 	// no logging is performed.
@@ -19,10 +34,187 @@ type Worker struct {
 	// One common practice is to assign the log.Println function to LogFunc.
 	LogFunc func(v ...interface{})
 
-	schema     *Schema
-	db         *sql.DB
-	drv        driver
-	initCalled bool
+	// Logger is an optional structured logger that is notified when each
+	// migration starts and finishes. If Logger is specified, the progress
+	// of each migration is reported to Logger instead of LogFunc. Other
+	// messages, such as the summary at the end of an operation, are still
+	// logged using LogFunc.
+	Logger Logger
+
+	// Environment is an optional label, such as "dev" or "prod", that is
+	// recorded against each database schema version applied by the worker.
+	Environment string
+
+	// RequireEnvironment prevents the worker from operating on a database
+	// that has schema versions recorded against a different environment.
+	// This guards against pointing a program at the wrong database.
+	RequireEnvironment bool
+
+	// AppliedBy optionally identifies the user or application that
+	// applies migrations, and is recorded against each database schema
+	// version applied by the worker. If not specified, the name of the
+	// operating system user is recorded.
+	AppliedBy string
+
+	// RunID optionally identifies an invocation of Up. When a run ID is
+	// specified, it is recorded once Up completes successfully, and any
+	// subsequent call to Up with the same run ID does nothing. This makes
+	// it safe for deployment tools to retry migrations.
+	//
+	// Run IDs are recorded in a table whose name is the migrations table
+	// name with a "_runs" suffix, such as "schema_migrations_runs". The
+	// name is derived rather than fixed so that each migrations table,
+	// such as one per tenant using TableNameFunc, has its own run IDs.
+	RunID string
+
+	// ErrorOnNoop causes Up, Down and Goto to return ErrNothingToDo
+	// instead of succeeding when there are no migrations to perform.
+	ErrorOnNoop bool
+
+	// ErrorOnUnknownVersions causes operations that read the database
+	// schema versions, such as Up and Versions, to fail if the database
+	// has an applied version that is not defined in the schema. This
+	// usually means that the program is older than the database, for
+	// example after a deployment has been rolled back.
+	//
+	// By default such versions are ignored.
+	ErrorOnUnknownVersions bool
+
+	// ValidateSQL is an optional function used by Lint to check the SQL
+	// for each migration, where direction is "up" or "down". It is not
+	// called for migrations implemented using Go functions.
+	ValidateSQL func(version VersionID, direction, sql string) error
+
+	// RecordTransactionalFailures causes a failed migration that was
+	// performed inside a transaction to be recorded as failed, in the
+	// same way as a failed non-transactional migration. The failure is
+	// recorded in a separate transaction after the migration has been
+	// rolled back, and is cleared using Force.
+	//
+	// By default a failed transactional migration leaves no record.
+	RecordTransactionalFailures bool
+
+	// AutoLock causes each version to be locked when it is migrated up,
+	// in the same transaction that records the version as applied. A
+	// locked version must be unlocked before it can be migrated down.
+	AutoLock bool
+
+	// SessionInit is an optional function that is called to initialize
+	// the database connection used to perform each migration, before the
+	// migration begins. It is useful for setting session variables that
+	// are read by audit triggers.
+	//
+	// SessionInit is not called for migrations defined using DBFunc, as
+	// these are not confined to a single connection.
+	SessionInit func(ctx context.Context, conn *sql.Conn) error
+
+	// BeforeEach and AfterEach are optional functions that are called
+	// before and after each up or down migration that is performed inside
+	// a transaction, in the same transaction as the migration. They are
+	// useful for changing session settings, such as a statement timeout,
+	// for the duration of a migration. If either function returns an error,
+	// the migration fails and the transaction is rolled back.
+	//
+	// BeforeEach and AfterEach are not called for migrations that are
+	// performed outside of a transaction, such as those defined using DBFunc.
+	BeforeEach func(ctx context.Context, tx *sql.Tx, id VersionID) error
+	AfterEach  func(ctx context.Context, tx *sql.Tx, id VersionID) error
+
+	// LockTimeoutSQL, if non-zero, limits the time that each migration
+	// will wait to acquire a database lock. The lock timeout is set on the
+	// connection used to perform each migration, and a migration that cannot
+	// acquire a lock within the timeout fails. It applies to postgres
+	// (lock_timeout), mysql (innodb_lock_wait_timeout, rounded up to
+	// whole seconds) and sqlserver (lock_timeout), and is ignored for
+	// other databases.
+	//
+	// LockTimeoutSQL does not apply to migrations defined using DBFunc.
+	LockTimeoutSQL time.Duration
+
+	// SQLiteForeignKeys, if not nil, turns SQLite foreign key enforcement
+	// on or off for the connection used to perform each migration. The
+	// setting is made before the migration transaction begins, because
+	// SQLite ignores it inside a transaction. The setting remains in effect
+	// for the connection after the migration. It is ignored for other
+	// databases, and for migrations defined using DBFunc.
+	SQLiteForeignKeys *bool
+
+	// SuppressFinishedLog prevents the worker from logging the summary
+	// message at the end of each operation. The summary is still available
+	// by calling LastSummary.
+	SuppressFinishedLog bool
+
+	// Confirm is an optional function that is called by Up and Goto
+	// with the migration steps to be performed, before any migrations
+	// are performed. If Confirm returns false, no migrations are performed.
+	// Confirm is not called if there is nothing to do.
+	Confirm func(steps []*PlannedStep) (bool, error)
+
+	// TableNameFunc, if not nil, returns the name of the migrations table
+	// to use for an operation, based on its context. This allows one worker
+	// to migrate the schemas of multiple tenants, each with its own
+	// migrations table. If TableNameFunc returns a blank name, the schema's
+	// MigrationsTable is used.
+	//
+	// The advisory lock held while changing the migrations table is derived
+	// from the migrations table name, so different tenants can be migrated
+	// in parallel, using a separate worker for each, while migrations for
+	// the same tenant are serialized.
+	TableNameFunc func(ctx context.Context) string
+
+	// OnComplete is an optional function that is called once after Up, Down
+	// or Goto completes successfully, with the name of the operation and
+	// the versions that were changed. It is not called if the operation
+	// fails, or if there was nothing to do because the run had already
+	// completed or the migrations were not confirmed.
+	OnComplete func(op string, result *RunResult)
+
+	// StateStore, if not nil, records which versions have been applied
+	// in place of the migrations table. The migrations themselves are
+	// still performed on the worker's database.
+	StateStore StateStore
+
+	// ShadowDB is an optional database that receives a trial run of Up
+	// before any migrations are performed on the worker's database. If
+	// any migration fails on the shadow database, Up returns the error
+	// without changing the worker's database. The shadow database must use
+	// the same dialect, and should be a disposable copy that is pre-seeded
+	// to match the schema of the worker's database.
+	ShadowDB *sql.DB
+
+	// CheckpointEvery, if greater than zero, causes Up to call
+	// CheckpointFunc after every CheckpointEvery migrations have been
+	// applied, with the version most recently applied. This is useful for
+	// running ANALYZE, pausing to reduce replication lag, or logging
+	// progress. CheckpointFunc is called between migrations, outside of
+	// any transaction. If it returns an error, Up stops and returns it.
+	CheckpointEvery int
+	CheckpointFunc  func(ctx context.Context, current VersionID) error
+
+	// RedactSQLInErrors prevents the SQL of a failed migration from being
+	// included in the error returned. By default the start of the SQL is
+	// included to help diagnose the failure, but it may contain sensitive
+	// literal values.
+	RedactSQLInErrors bool
+
+	// SplitStatements causes the SQL for each migration to be split into
+	// individual statements, which are executed in turn. This is needed
+	// for databases whose driver does not permit multiple statements in
+	// one call, such as MySQL unless the multiStatements parameter is set.
+	// Statements are split at each semicolon that is not inside a quoted
+	// string or a comment, so it is not suitable for migrations that create
+	// stored procedures containing semicolons, except for PostgreSQL
+	// functions whose body is dollar-quoted.
+	SplitStatements bool
+
+	schema      *Schema
+	db          *sql.DB
+	drv         Driver
+	initTables  map[string]bool
+	lastSummary *Summary
+	runFrom     VersionID
+	runChanged  []VersionID
+	warned      map[VersionID]bool
 }
 
 // NewWorker creates a worker that can perform migrations for
@@ -43,33 +235,344 @@ func NewWorker(db *sql.DB, schema *Schema) (*Worker, error) {
 	return cmd, nil
 }
 
+// NewWorkerWithDialect creates a worker that uses the specified SQL
+// dialect, which is one of "postgres", "sqlite", "mysql", "sqlserver",
+// "cockroach" or "oracle".
+//
+// NewWorker determines the dialect from the type of the database
+// driver. Use NewWorkerWithDialect when this is not possible, for example
+// when connecting via a proxy driver, or when connecting to CockroachDB
+// using the PostgreSQL driver.
+func NewWorkerWithDialect(db *sql.DB, schema *Schema, dialect string) (*Worker, error) {
+	if err := schema.Err(); err != nil {
+		return nil, err
+	}
+	drv, err := findDialect(dialect)
+	if err != nil {
+		return nil, err
+	}
+	cmd := &Worker{
+		schema: schema,
+		db:     db,
+		drv:    drv,
+	}
+	return cmd, nil
+}
+
+// NewWorkerNamed creates a worker that uses the migration driver
+// registered for the database/sql driver name used to open the database.
+// Drivers are registered using RegisterDriverForName, and the names
+// "postgres", "sqlite3", "mysql", "mssql", "sqlserver", "godror" and
+// "oracle" are registered by default.
+//
+// Unlike NewWorker, NewWorkerNamed does not inspect the type of the
+// database driver, so the mapping to a dialect is deterministic.
+func NewWorkerNamed(db *sql.DB, schema *Schema, sqlDriverName string) (*Worker, error) {
+	if err := schema.Err(); err != nil {
+		return nil, err
+	}
+	drv, err := findNamedDriver(sqlDriverName)
+	if err != nil {
+		return nil, err
+	}
+	cmd := &Worker{
+		schema: schema,
+		db:     db,
+		drv:    drv,
+	}
+	return cmd, nil
+}
+
+// TestRoundTrip checks that the down migrations reverse the up migrations,
+// and is intended for use in tests with an empty database, such as an
+// in-memory SQLite database. It migrates the database up to the latest
+// version and then down to version zero, and returns an error listing any
+// tables, indexes or views that were not there before migrating up. As
+// with DumpSchemaDDL, the migrations tables must use the default name.
+func (m *Worker) TestRoundTrip(ctx context.Context) error {
+	if err := checkContext(ctx, "round trip"); err != nil {
+		return err
+	}
+	before, err := m.drv.DumpSchemaDDL(ctx, m.db)
+	if err != nil {
+		return err
+	}
+	if err = m.Up(ctx); err != nil {
+		return err
+	}
+	if err = m.Goto(ctx, 0); err != nil {
+		return err
+	}
+	after, err := m.drv.DumpSchemaDDL(ctx, m.db)
+	if err != nil {
+		return err
+	}
+	existing := make(map[string]bool)
+	for _, stmt := range before {
+		existing[stmt] = true
+	}
+	var leftover []string
+	for _, stmt := range after {
+		if !existing[stmt] {
+			leftover = append(leftover, strings.TrimSpace(stmt))
+		}
+	}
+	if len(leftover) > 0 {
+		return fmt.Errorf("round trip left %d schema objects after migrating down:\n%s",
+			len(leftover), strings.Join(leftover, "\n"))
+	}
+	return nil
+}
+
+// WithDB returns a new worker for the database db, with the same schema
+// and configuration as m. The schema has already been validated, so it
+// is not validated again. This is cheaper than calling NewWorker for each
+// database when migrating many databases with the same schema, such as
+// one database per tenant.
+//
+// The database must use the same dialect as the worker's database, because
+// the dialect is not determined again.
+func (m *Worker) WithDB(db *sql.DB) (*Worker, error) {
+	if db == nil {
+		return nil, errors.New("cannot create worker: db is nil")
+	}
+	w := *m
+	w.db = db
+	w.initTables = nil
+	w.lastSummary = nil
+	w.runFrom = 0
+	w.runChanged = nil
+	w.warned = nil
+	return &w, nil
+}
+
 // Up migrates the database to the latest version.
 func (m *Worker) Up(ctx context.Context) error {
-	if err := m.init(ctx); err != nil {
+	if err := checkContext(ctx, "migrate up"); err != nil {
 		return err
 	}
-	for {
+	release, err := m.advisoryLock(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+	if err = m.init(ctx); err != nil {
+		return err
+	}
+	if err := m.checkChecksums(ctx); err != nil {
+		return err
+	}
+	if m.RunID != "" {
+		completed, err := m.runCompleted(ctx)
+		if err != nil {
+			return err
+		}
+		if completed {
+			m.log(fmt.Sprintf("run already completed run_id=%s", m.RunID))
+			return nil
+		}
+	}
+	if err := m.checkNothingToDo(ctx, "up", 0); err != nil {
+		return err
+	}
+	if ok, err := m.confirm(ctx, "up", 0); err != nil || !ok {
+		return err
+	}
+	if err := m.shadowUp(ctx); err != nil {
+		return err
+	}
+	if err := m.beginRun(ctx); err != nil {
+		return err
+	}
+	if err := m.applyCheckpoint(ctx, 0); err != nil {
+		return err
+	}
+	for applied := 0; ; {
 		more, err := m.upOne(ctx)
 		if err != nil {
 			return err
 		}
+		if n := len(m.runChanged); n > applied {
+			applied = n
+			if err = m.checkpointFunc(ctx, applied); err != nil {
+				return err
+			}
+		}
 		if !more {
 			m.finished(ctx, "migrate up finished")
 			break
 		}
 	}
+	if m.RunID != "" {
+		err := m.transact(ctx, func(tx *sql.Tx) error {
+			return m.drv.InsertRun(ctx, tx, m.runsTableName(ctx), m.RunID, time.Now())
+		})
+		if err != nil {
+			return err
+		}
+	}
+	m.completeRun("up")
+	return nil
+}
+
+// Plan returns the migration steps that Up would perform, in order,
+// without performing them. Migrations implemented using Go functions
+// are described by a placeholder such as "(TxFunc)" in place of the SQL.
+// Plan returns an error if the database is in a state that would
+// prevent Up from running, such as having a failed version.
+func (m *Worker) Plan(ctx context.Context) ([]*PlannedStep, error) {
+	if err := m.init(ctx); err != nil {
+		return nil, err
+	}
+	var steps []*PlannedStep
+	err := m.transact(ctx, func(tx *sql.Tx) error {
+		vs, err := m.getVersionSummary(ctx, tx)
+		if err != nil {
+			return err
+		}
+		steps = vs.steps("up", 0)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return steps, nil
+}
+
+// checkChecksums reports an error if the up migration of an applied
+// version has changed since it was applied. Versions applied before
+// checksums were recorded, and migrations implemented in Go, are not
+// checked.
+func (m *Worker) checkChecksums(ctx context.Context) error {
+	return m.transact(ctx, func(tx *sql.Tx) error {
+		vs, err := m.getVersionSummaryAllowFailed(ctx, tx)
+		if err != nil {
+			return err
+		}
+		for i := len(vs.applied) - 1; i >= 0; i-- {
+			plan := vs.applied[i]
+			if checksumMismatch(plan, vs.vmap[plan.id].Checksum) {
+				return fmt.Errorf("version %d has been modified since it was applied: checksum mismatch", plan.id)
+			}
+		}
+		return nil
+	})
+}
+
+// checksumMismatch reports whether the checksum stored when a version
+// was applied differs from the checksum of its up migration. Versions
+// without a stored checksum, and Go functions, are never mismatched.
+func checksumMismatch(plan *migrationPlan, stored string) bool {
+	if stored == "" || stored == goChecksum {
+		return false
+	}
+	checksum := plan.up.checksum()
+	return checksum != goChecksum && checksum != stored
+}
+
+// runCompleted reports whether the worker's run ID has been recorded
+// as completed.
+func (m *Worker) runCompleted(ctx context.Context) (completed bool, err error) {
+	if err = m.drv.CreateRunsTable(ctx, m.db, m.runsTableName(ctx)); err != nil {
+		return false, err
+	}
+	err = m.transact(ctx, func(tx *sql.Tx) error {
+		completed, err = m.drv.RunCompleted(ctx, tx, m.runsTableName(ctx), m.RunID)
+		return err
+	})
+	return completed, err
+}
+
+// checkpointFunc calls the CheckpointFunc function, if any, when
+// the number of migrations applied by Up is a multiple of CheckpointEvery.
+func (m *Worker) checkpointFunc(ctx context.Context, applied int) error {
+	if m.CheckpointFunc == nil || m.CheckpointEvery <= 0 || applied%m.CheckpointEvery != 0 {
+		return nil
+	}
+	current := m.runChanged[applied-1]
+	if err := m.CheckpointFunc(ctx, current); err != nil {
+		return wrapf(err, "checkpoint after version %d", current)
+	}
+	return nil
+}
+
+// shadowUp performs a trial run of Up on the shadow database, if one
+// has been specified.
+func (m *Worker) shadowUp(ctx context.Context) error {
+	if m.ShadowDB == nil {
+		return nil
+	}
+	shadow := &Worker{
+		Environment:         m.Environment,
+		AppliedBy:           m.AppliedBy,
+		SessionInit:         m.SessionInit,
+		LockTimeoutSQL:      m.LockTimeoutSQL,
+		SQLiteForeignKeys:   m.SQLiteForeignKeys,
+		SplitStatements:     m.SplitStatements,
+		SuppressFinishedLog: true,
+		TableNameFunc:       m.TableNameFunc,
+		schema:              m.schema,
+		db:                  m.ShadowDB,
+		drv:                 m.drv,
+	}
+	if m.LogFunc != nil {
+		shadow.LogFunc = func(v ...interface{}) {
+			m.LogFunc(append([]interface{}{"shadow:"}, v...)...)
+		}
+	}
+	if err := shadow.Up(ctx); err != nil {
+		return wrapf(err, "shadow database")
+	}
 	return nil
 }
 
 // Down migrates the database down to the latest locked version.
 // If there are no locked versions, all down migrations are performed.
+// If Down stops at a locked version, it returns an error that wraps
+// ErrVersionLocked, after migrating down any later versions.
 func (m *Worker) Down(ctx context.Context) error {
-	if err := m.init(ctx); err != nil {
+	return m.down(ctx, false)
+}
+
+// ForceDown migrates the database down, performing all down migrations
+// including those of locked versions.
+func (m *Worker) ForceDown(ctx context.Context) error {
+	return m.down(ctx, true)
+}
+
+// down migrates the database down. If force is true, locked
+// versions are migrated down, otherwise down stops at the
+// latest locked version.
+func (m *Worker) down(ctx context.Context, force bool) error {
+	if err := checkContext(ctx, "migrate down"); err != nil {
+		return err
+	}
+	release, err := m.advisoryLock(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+	if err = m.init(ctx); err != nil {
+		return err
+	}
+	op := "down"
+	if force {
+		op = "force down"
+	}
+	if err := m.checkNothingToDo(ctx, op, 0); err != nil {
+		return err
+	}
+	if err := m.beginRun(ctx); err != nil {
 		return err
 	}
 	for {
-		more, err := m.downOne(ctx)
+		more, err := m.downOne(ctx, force)
 		if err != nil {
+			if errors.Is(err, ErrVersionLocked) {
+				// stopped at a locked version, which is not a failure
+				m.finished(ctx, "migrate down finished")
+				m.completeRun("down")
+			}
 			return err
 		}
 		if !more {
@@ -77,12 +580,16 @@ func (m *Worker) Down(ctx context.Context) error {
 			break
 		}
 	}
+	m.completeRun("down")
 	return nil
 }
 
 // Version returns details of the specified version.
 func (m *Worker) Version(ctx context.Context, id VersionID) (*Version, error) {
 	var err error
+	if err = checkContext(ctx, "get version"); err != nil {
+		return nil, err
+	}
 	if err = m.checkVersion(id); err != nil {
 		return nil, err
 	}
@@ -109,12 +616,50 @@ func (m *Worker) Version(ctx context.Context, id VersionID) (*Version, error) {
 	return version, nil
 }
 
+// DetectVersion determines the database schema version of a database that
+// has not been managed by migrations, by calling a probe function that
+// reports whether the changes for each version are present. Probes are
+// called in version order, and DetectVersion returns the highest version
+// whose probe, and the probes for all lower versions, report true. It
+// returns zero if the probe for the lowest version reports false.
+//
+// The version returned can be passed to Baseline to adopt the database,
+// provided that it is not zero.
+func (m *Worker) DetectVersion(ctx context.Context, probes map[VersionID]func(context.Context, *sql.DB) (bool, error)) (VersionID, error) {
+	ids := make([]VersionID, 0, len(probes))
+	for id := range probes {
+		if err := m.checkVersion(id); err != nil {
+			return 0, err
+		}
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i] < ids[j]
+	})
+
+	var detected VersionID
+	for _, id := range ids {
+		present, err := probes[id](ctx, m.db)
+		if err != nil {
+			return 0, wrapf(err, "probe %d", id)
+		}
+		if !present {
+			break
+		}
+		detected = id
+	}
+	return detected, nil
+}
+
 // Force the database schema to a specific version.
 //
 // This is used to manually fix a database after a non-transactional
 // migration has failed.
 func (m *Worker) Force(ctx context.Context, id VersionID) error {
 	var err error
+	if err = checkContext(ctx, "force"); err != nil {
+		return err
+	}
 
 	// a version id of zero is permitted for force
 	if id != 0 {
@@ -122,6 +667,11 @@ func (m *Worker) Force(ctx context.Context, id VersionID) error {
 			return err
 		}
 	}
+	release, err := m.advisoryLock(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
 	if err = m.init(ctx); err != nil {
 		return err
 	}
@@ -130,40 +680,22 @@ func (m *Worker) Force(ctx context.Context, id VersionID) error {
 		if err != nil {
 			return err
 		}
-		// check for any locked versions that would prevent rolling back
-		if err = vs.checkLocked(id); err != nil {
+		deleted, cleared, err := vs.forcePlan(id)
+		if err != nil {
 			return err
 		}
-
-		if id != 0 {
-			var found bool
-			for _, plan := range vs.applied {
-				if plan.id == id {
-					found = true
-					break
-				}
-			}
-
-			if !found {
-				return fmt.Errorf("cannot force unapplied version id=%d", id)
+		for _, v := range deleted {
+			if err = m.deleteVersion(ctx, tx, v); err != nil {
+				return err
 			}
+			m.log(fmt.Sprintf("deleted database schema version id=%d", v))
 		}
-
-		for _, plan := range vs.applied {
-			ver := vs.vmap[plan.id]
-			if ver.ID > id {
-				if err = m.drv.DeleteVersion(ctx, tx, m.tableName(), ver.ID); err != nil {
-					return err
-				}
-				m.log(fmt.Sprintf("deleted database schema version id=%d", ver.ID))
-			} else if ver.Failed {
-				if err = m.drv.SetVersionFailed(ctx, tx, m.tableName(), ver.ID, false); err != nil {
-					return err
-				}
-				m.log(fmt.Sprintf("cleared database schema version failure id=%d", id))
+		for _, v := range cleared {
+			if err = m.store(ctx).SetFailed(ctx, tx, v, false); err != nil {
+				return err
 			}
+			m.log(fmt.Sprintf("cleared database schema version failure id=%d", v))
 		}
-
 		return nil
 	})
 	if err != nil {
@@ -175,151 +707,1497 @@ func (m *Worker) Force(ctx context.Context, id VersionID) error {
 	return nil
 }
 
-// Lock a database schema version.
-//
-// This is used to prevent accidental down migrations. When a database
-// version is locked, it is not possible to perform a down migration to
-// the previous version.
-func (m *Worker) Lock(ctx context.Context, id VersionID) error {
-	return m.lockHelper(ctx, id, "lock", true)
-}
-
-// Unlock a database schema version.
-func (m *Worker) Unlock(ctx context.Context, id VersionID) error {
-	return m.lockHelper(ctx, id, "unlock", false)
+// Retry performs the up migration of the failed database schema version
+// id again, and clears its failed status if the migration succeeds. This
+// resumes a non-transactional migration that was interrupted, so the up
+// migration must be able to handle any changes made by the earlier attempt.
+// Retry fails if version id is not marked as failed.
+func (m *Worker) Retry(ctx context.Context, id VersionID) error {
+	if err := checkContext(ctx, "retry"); err != nil {
+		return err
+	}
+	if err := m.checkVersion(id); err != nil {
+		return err
+	}
+	release, err := m.advisoryLock(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+	if err = m.init(ctx); err != nil {
+		return err
+	}
+	err = m.transact(ctx, func(tx *sql.Tx) error {
+		vs, err := m.getVersionSummaryAllowFailed(ctx, tx)
+		if err != nil {
+			return err
+		}
+		if ver := vs.vmap[id]; ver == nil || !ver.Failed {
+			return fmt.Errorf("cannot retry version id=%d: version has not failed", id)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	start := m.migrationStarted(id, "up")
+	err = m.upOneNoTx(ctx, id)
+	m.migrationFinished(id, "up", start, err)
+	if err != nil {
+		return err
+	}
+	m.finished(ctx, "retry finished")
+	return nil
 }
 
-func (m *Worker) lockHelper(ctx context.Context, id VersionID, verb string, lock bool) error {
-	var err error
-	if err = m.checkVersion(id); err != nil {
+// Baseline marks an existing database, whose schema was created without
+// using migrations, as being at the database schema version id. Version
+// records are inserted for each version up to and including id, without
+// performing their up migrations. Baseline fails if the database already
+// has any version records.
+func (m *Worker) Baseline(ctx context.Context, id VersionID) error {
+	if err := checkContext(ctx, "baseline"); err != nil {
+		return err
+	}
+	if err := m.checkVersion(id); err != nil {
+		return err
+	}
+	release, err := m.advisoryLock(ctx)
+	if err != nil {
 		return err
 	}
+	defer release()
 	if err = m.init(ctx); err != nil {
 		return err
 	}
 	err = m.transact(ctx, func(tx *sql.Tx) error {
-		vs, err := m.getVersionSummary(ctx, tx)
+		versions, err := m.listVersions(ctx, tx)
 		if err != nil {
 			return err
 		}
-
-		var found bool
-		for _, plan := range vs.applied {
-			if plan.id == id {
-				found = true
+		if len(versions) > 0 {
+			return fmt.Errorf("cannot baseline version id=%d: database has %d version records", id, len(versions))
+		}
+		now := time.Now()
+		for _, plan := range m.schema.plans {
+			if plan.id > id {
 				break
 			}
+			ver := &Version{
+				ID:          plan.id,
+				AppliedAt:   &now,
+				Locked:      m.AutoLock,
+				Environment: m.Environment,
+				AppliedBy:   m.appliedBy(),
+			}
+			if err = m.insertVersion(ctx, tx, plan, ver); err != nil {
+				return wrapf(err, "%d", plan.id)
+			}
 		}
-
-		if !found {
-			return fmt.Errorf("cannot %s unapplied version id=%d", verb, id)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	m.log(fmt.Sprintf("baseline version=%d", id))
+	m.finished(ctx, "baseline finished")
+	return nil
+}
+
+// CleanupFailed performs the down migration of the failed database schema
+// version, to undo any changes made by its partially completed up migration,
+// and then deletes the version record so that Up can retry the version.
+//
+// Unlike Force, which marks the failed version as applied, CleanupFailed
+// leaves the database as it was before the failed migration began, provided
+// that the down migration can handle a partially completed up migration.
+func (m *Worker) CleanupFailed(ctx context.Context) error {
+	release, err := m.advisoryLock(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+	if err = m.init(ctx); err != nil {
+		return err
+	}
+	var failed []VersionID
+	err = m.transact(ctx, func(tx *sql.Tx) error {
+		vs, err := m.getVersionSummaryAllowFailed(ctx, tx)
+		if err != nil {
+			return err
+		}
+		for _, ver := range vs.versions {
+			if ver.Failed {
+				failed = append(failed, ver.ID)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(failed) == 0 {
+		return errors.New("no failed database schema version")
+	}
+	if len(failed) > 1 {
+		return fmt.Errorf("multiple failed database schema versions: %v", failed)
+	}
+	id := failed[0]
+	var plan *migrationPlan
+	for _, p := range m.schema.plans {
+		if p.id == id {
+			plan = p
+			break
+		}
+	}
+	if plan == nil {
+		return fmt.Errorf("missing plan for version %d", id)
+	}
+
+	down := plan.down
+	switch {
+	case down.txFunc != nil:
+		err = m.migrationTx(ctx, func(tx *sql.Tx) error {
+			return down.txFunc(ctx, tx)
+		})
+	case down.dbFunc != nil:
+		err = down.dbFunc(ctx, m.db)
+	case down.batch != nil:
+		err = m.runBatches(ctx, id, down.batch)
+	default:
+		err = m.applyNoTx(ctx, &down)
+	}
+	if err != nil {
+		return wrapf(err, "%d", id)
+	}
+
+	// success, so delete version record
+	err = m.transact(ctx, func(tx *sql.Tx) error {
+		return m.deleteVersion(ctx, tx, id)
+	})
+	if err != nil {
+		return err
+	}
+	m.log(fmt.Sprintf("cleaned up failed version=%d", id))
+	m.finished(ctx, "cleanup failed finished")
+	return nil
+}
+
+// ForcePlan reports what Force would do for the version id, without
+// changing the database. The deleted versions are the applied versions
+// above id, whose version records would be deleted. The cleared versions
+// are the failed versions at or below id, whose failure would be cleared.
+func (m *Worker) ForcePlan(ctx context.Context, id VersionID) (deleted []VersionID, cleared []VersionID, err error) {
+	// a version id of zero is permitted for force
+	if id != 0 {
+		if err = m.checkVersion(id); err != nil {
+			return nil, nil, err
+		}
+	}
+	if err = m.init(ctx); err != nil {
+		return nil, nil, err
+	}
+	err = m.transact(ctx, func(tx *sql.Tx) error {
+		vs, err := m.getVersionSummaryAllowFailed(ctx, tx)
+		if err != nil {
+			return err
+		}
+		deleted, cleared, err = vs.forcePlan(id)
+		return err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return deleted, cleared, nil
+}
+
+// Lock a database schema version.
+//
+// This is used to prevent accidental down migrations. When a database
+// version is locked, it is not possible to perform a down migration to
+// the previous version.
+func (m *Worker) Lock(ctx context.Context, id VersionID) error {
+	return m.lockHelper(ctx, id, "lock", true)
+}
+
+// Unlock a database schema version.
+func (m *Worker) Unlock(ctx context.Context, id VersionID) error {
+	return m.lockHelper(ctx, id, "unlock", false)
+}
+
+func (m *Worker) lockHelper(ctx context.Context, id VersionID, verb string, lock bool) error {
+	var err error
+	if err = checkContext(ctx, verb); err != nil {
+		return err
+	}
+	if err = m.checkVersion(id); err != nil {
+		return err
+	}
+	release, err := m.advisoryLock(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+	if err = m.init(ctx); err != nil {
+		return err
+	}
+	err = m.transact(ctx, func(tx *sql.Tx) error {
+		vs, err := m.getVersionSummary(ctx, tx)
+		if err != nil {
+			return err
+		}
+
+		var found bool
+		for _, plan := range vs.applied {
+			if plan.id == id {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return fmt.Errorf("cannot %s unapplied version id=%d", verb, id)
+		}
+
+		return m.store(ctx).SetLocked(ctx, tx, id, lock)
+	})
+	if err != nil {
+		return err
+	}
+
+	m.log(fmt.Sprintf("%s version=%d", verb, id))
+
+	return nil
+}
+
+// RevertOne performs the down migration for a single database schema
+// version, without performing the down migrations for any later versions
+// that have been applied. RevertOne fails if the version is locked or
+// has not been applied.
+//
+// Use RevertOne with extreme care. Later versions may depend on the changes
+// made by the reverted version, and the package has no way of knowing
+// about any such dependency. The usual reason for reverting a single version
+// is to re-apply a corrected version of its up migration using Up.
+func (m *Worker) RevertOne(ctx context.Context, id VersionID) error {
+	if err := m.checkVersion(id); err != nil {
+		return err
+	}
+	release, err := m.advisoryLock(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+	if err = m.init(ctx); err != nil {
+		return err
+	}
+	if _, err = m.downVersion(ctx, id, false); err != nil {
+		return err
+	}
+	m.finished(ctx, "revert finished")
+	return nil
+}
+
+// UpN migrates up at most n versions, and returns the number of
+// versions migrated. It is equivalent to calling Goto with the nth
+// unapplied version, or the latest version if fewer than n are unapplied.
+func (m *Worker) UpN(ctx context.Context, n int) (int, error) {
+	return m.gotoN(ctx, "up", n)
+}
+
+// DownN migrates down at most n versions, and returns the number of
+// versions migrated. As with Goto, it is not possible to migrate down
+// from a locked version.
+func (m *Worker) DownN(ctx context.Context, n int) (int, error) {
+	return m.gotoN(ctx, "down", n)
+}
+
+// gotoN migrates at most n versions in the direction dir, which is
+// either "up" or "down".
+func (m *Worker) gotoN(ctx context.Context, dir string, n int) (int, error) {
+	if n <= 0 {
+		return 0, fmt.Errorf("invalid number of versions to migrate %s: %d", dir, n)
+	}
+	if err := checkContext(ctx, "migrate goto"); err != nil {
+		return 0, err
+	}
+	release, err := m.advisoryLock(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+	if err = m.init(ctx); err != nil {
+		return 0, err
+	}
+	var target VersionID
+	err = m.transact(ctx, func(tx *sql.Tx) error {
+		vs, err := m.getVersionSummary(ctx, tx)
+		if err != nil {
+			return err
+		}
+		if len(vs.applied) > 0 {
+			target = vs.applied[0].id
+		}
+		switch {
+		case dir == "up" && len(vs.unapplied) > 0:
+			if n > len(vs.unapplied) {
+				n = len(vs.unapplied)
+			}
+			if id := vs.unapplied[n-1].id; id > target {
+				target = id
+			}
+		case dir == "down" && n < len(vs.applied):
+			target = vs.applied[n].id
+		case dir == "down":
+			target = 0
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	m.runChanged = nil
+	if err = m.gotoVersion(ctx, target); err != nil {
+		return 0, err
+	}
+	return len(m.runChanged), nil
+}
+
+// Goto migrates up or down to the specified version.
+//
+// If id is zero, then all down migrations are applied
+// to result in an empty database.
+func (m *Worker) Goto(ctx context.Context, id VersionID) error {
+	if err := checkContext(ctx, "migrate goto"); err != nil {
+		return err
+	}
+	// id=0 is a special case, remove all migrations
+	if id != 0 {
+		if err := m.checkVersion(id); err != nil {
+			return err
+		}
+	}
+	release, err := m.advisoryLock(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+	if err = m.init(ctx); err != nil {
+		return err
+	}
+	return m.gotoVersion(ctx, id)
+}
+
+// gotoVersion migrates up or down to the version id. The caller
+// must hold the advisory lock.
+func (m *Worker) gotoVersion(ctx context.Context, id VersionID) error {
+	if err := m.checkNothingToDo(ctx, "goto", id); err != nil {
+		return err
+	}
+	if ok, err := m.confirm(ctx, "goto", id); err != nil || !ok {
+		return err
+	}
+	if err := m.beginRun(ctx); err != nil {
+		return err
+	}
+	if id != 0 {
+		if err := m.applyCheckpoint(ctx, id); err != nil {
+			return err
+		}
+	}
+	for {
+		more, err := m.gotoOne(ctx, id)
+		if err != nil {
+			return err
+		}
+		if !more {
+			m.finished(ctx, "migrate goto finished")
+			break
+		}
+	}
+	m.completeRun("goto")
+	return nil
+}
+
+// VersionMeta returns the metadata recorded for the database schema
+// version when it was migrated up. The metadata for a version is
+// specified using the SetMeta method of its definition.
+func (m *Worker) VersionMeta(ctx context.Context, id VersionID) (map[string]string, error) {
+	if err := m.init(ctx); err != nil {
+		return nil, err
+	}
+	var meta map[string]string
+	err := m.transact(ctx, func(tx *sql.Tx) error {
+		var err error
+		meta, err = m.drv.ListMetadata(ctx, tx, m.metaTableName(ctx), id)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
+
+// Versions lists all of the database schema versions.
+func (m *Worker) Versions(ctx context.Context) ([]*Version, error) {
+	var versions []*Version
+	if err := m.init(ctx); err != nil {
+		return versions, err
+	}
+	err := m.transact(ctx, func(tx *sql.Tx) error {
+		vs, err := m.getVersionSummaryAllowFailed(ctx, tx)
+		if err != nil {
+			return err
+		}
+		versions = vs.versions
+
+		return nil
+	})
+	return versions, err
+}
+
+// Pending lists the database schema versions that have not been
+// applied to the database, in ascending order of version id.
+func (m *Worker) Pending(ctx context.Context) ([]*Version, error) {
+	if err := m.init(ctx); err != nil {
+		return nil, err
+	}
+	var pending []*Version
+	err := m.transact(ctx, func(tx *sql.Tx) error {
+		vs, err := m.getVersionSummary(ctx, tx)
+		if err != nil {
+			return err
+		}
+		for _, plan := range vs.unapplied {
+			pending = append(pending, vs.vmap[plan.id])
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return pending, nil
+}
+
+// NeedsAttention lists the database schema versions that are either
+// failed or locked, in ascending order of version id.
+func (m *Worker) NeedsAttention(ctx context.Context) ([]*Version, error) {
+	versions, err := m.Versions(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var attention []*Version
+	for _, ver := range versions {
+		if ver.Failed || ver.Locked {
+			attention = append(attention, ver)
+		}
+	}
+	return attention, nil
+}
+
+// MustBeUpToDate returns an error if the database schema has any
+// pending migrations. The error lists the pending version ids. No
+// migrations are performed.
+//
+// This is intended to be called at program startup by services that
+// should not run against an out of date database schema.
+func (m *Worker) MustBeUpToDate(ctx context.Context) error {
+	if err := m.init(ctx); err != nil {
+		return err
+	}
+	return m.transact(ctx, func(tx *sql.Tx) error {
+		vs, err := m.getVersionSummary(ctx, tx)
+		if err != nil {
+			return err
+		}
+		if len(vs.unapplied) == 0 {
+			return nil
+		}
+		ids := make([]string, 0, len(vs.unapplied))
+		for _, plan := range vs.unapplied {
+			ids = append(ids, fmt.Sprint(plan.id))
+		}
+		return fmt.Errorf("database schema is not up to date: pending versions %s", strings.Join(ids, ", "))
+	})
+}
+
+// IsUpToDate reports whether all versions in the schema have been applied
+// to the database, and none have failed. Unlike MustBeUpToDate, it does not
+// create the migrations table, so it performs no DDL. If the migrations table
+// does not exist an error is returned.
+func (m *Worker) IsUpToDate(ctx context.Context) (bool, error) {
+	var upToDate bool
+	err := m.transact(ctx, func(tx *sql.Tx) error {
+		vs, err := m.getVersionSummaryAllowFailed(ctx, tx)
+		if err != nil {
+			return err
+		}
+		for _, ver := range vs.versions {
+			if ver.Failed {
+				return nil
+			}
+		}
+		upToDate = len(vs.unapplied) == 0
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+	return upToDate, nil
+}
+
+// WaitUntilUpToDate waits until the database schema is up to date, as
+// reported by IsUpToDate, or until the context is done. It is intended
+// for use by processes that need the schema to be current, but leave the
+// migrations to another process.
+//
+// The database is polled after pollInterval, and the interval doubles
+// after each poll up to a maximum of eight times pollInterval. Errors,
+// such as the migrations table not existing yet, do not stop the polling,
+// but the most recent error is returned if the context is done.
+// No migrations are performed.
+func (m *Worker) WaitUntilUpToDate(ctx context.Context, pollInterval time.Duration) error {
+	if pollInterval <= 0 {
+		return errors.New("poll interval must be positive")
+	}
+	var lastErr error
+	delay := pollInterval
+	for {
+		upToDate, err := m.IsUpToDate(ctx)
+		if err == nil && upToDate {
+			return nil
+		}
+		lastErr = err
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			if lastErr != nil {
+				return wrapf(lastErr, "database schema is not up to date")
+			}
+			return ctx.Err()
+		case <-timer.C:
+		}
+		if delay *= 2; delay > 8*pollInterval {
+			delay = 8 * pollInterval
+		}
+	}
+}
+
+// PendingCount returns the number of versions in the schema that have
+// not been applied to the database. It is the same as the Pending count
+// returned by Snapshot.
+func (m *Worker) PendingCount(ctx context.Context) (int, error) {
+	snapshot, err := m.Snapshot(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return snapshot.Pending, nil
+}
+
+// Status returns the current applied version, the number of pending
+// versions, and whether any versions are failed or locked. Status is
+// derived from Snapshot, so the two always agree.
+func (m *Worker) Status(ctx context.Context) (*Status, error) {
+	snapshot, err := m.Snapshot(ctx)
+	if err != nil {
+		return nil, err
+	}
+	status := &Status{
+		Current: snapshot.Version,
+		Pending: snapshot.Pending,
+		Failed:  snapshot.Failed > 0,
+		Locked:  snapshot.LockedVersion,
+	}
+	return status, nil
+}
+
+// Attest returns an attestation of the versions applied to the database,
+// signed using the sign function. The attestation data is JSON that lists
+// the id and checksum of each applied version in version order, and is
+// identical for databases with the same applied versions. Verifying the
+// signature is the responsibility of the caller.
+func (m *Worker) Attest(ctx context.Context, sign func(data []byte) ([]byte, error)) (*Attestation, error) {
+	if err := m.init(ctx); err != nil {
+		return nil, err
+	}
+	type attestVersion struct {
+		ID       VersionID `json:"id"`
+		Checksum string    `json:"checksum,omitempty"`
+		Failed   bool      `json:"failed,omitempty"`
+	}
+	var payload struct {
+		Table    string          `json:"table"`
+		Versions []attestVersion `json:"versions"`
+	}
+	payload.Table = m.tableName(ctx)
+	payload.Versions = []attestVersion{}
+	err := m.transact(ctx, func(tx *sql.Tx) error {
+		versions, err := m.listVersions(ctx, tx)
+		if err != nil {
+			return err
+		}
+		sort.Slice(versions, func(i, j int) bool {
+			return versions[i].ID < versions[j].ID
+		})
+		for _, ver := range versions {
+			payload.Versions = append(payload.Versions, attestVersion{
+				ID:       ver.ID,
+				Checksum: ver.Checksum,
+				Failed:   ver.Failed,
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(&payload)
+	if err != nil {
+		return nil, err
+	}
+	signature, err := sign(data)
+	if err != nil {
+		return nil, wrapf(err, "cannot sign attestation")
+	}
+	return &Attestation{
+		Data:      data,
+		Signature: signature,
+	}, nil
+}
+
+// Report returns a report comparing the versions applied to the database
+// with the versions defined in the schema. The migrations table is read
+// once, and no migrations are performed.
+func (m *Worker) Report(ctx context.Context) (*Report, error) {
+	if err := m.init(ctx); err != nil {
+		return nil, err
+	}
+	report := &Report{
+		Pending:    []*ReportPending{},
+		Applied:    []*ReportVersion{},
+		Orphaned:   []VersionID{},
+		Mismatches: []*ReportMismatch{},
+	}
+	plans := make(map[VersionID]*migrationPlan, len(m.schema.plans))
+	for _, plan := range m.schema.plans {
+		plans[plan.id] = plan
+	}
+	err := m.transact(ctx, func(tx *sql.Tx) error {
+		versions, err := m.listVersions(ctx, tx)
+		if err != nil {
+			return err
+		}
+		applied := make(map[VersionID]bool, len(versions))
+		for _, ver := range versions {
+			applied[ver.ID] = true
+			if ver.ID > report.Version {
+				report.Version = ver.ID
+			}
+			report.Applied = append(report.Applied, &ReportVersion{
+				ID:        ver.ID,
+				AppliedAt: ver.AppliedAt,
+				Failed:    ver.Failed,
+				Locked:    ver.Locked,
+				Skipped:   ver.Skipped,
+				Checksum:  ver.Checksum,
+			})
+			plan, ok := plans[ver.ID]
+			if !ok {
+				report.Orphaned = append(report.Orphaned, ver.ID)
+			} else if checksumMismatch(plan, ver.Checksum) {
+				report.Mismatches = append(report.Mismatches, &ReportMismatch{
+					ID:       ver.ID,
+					Applied:  ver.Checksum,
+					Checksum: plan.up.checksum(),
+				})
+			}
+		}
+		for _, plan := range m.schema.plans {
+			if !applied[plan.id] {
+				report.Pending = append(report.Pending, &ReportPending{
+					ID:   plan.id,
+					Name: plan.name,
+				})
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// Verify checks that the database schema versions are consistent with
+// the schema, and is intended to be called at program startup. It reports
+// each failed version, each applied version that is not defined in the
+// schema, which indicates that the program is older than the database,
+// and each unapplied version that is lower than the highest applied
+// version. Any errors are reported together, and will be of type Errors.
+// No migrations are performed.
+func (m *Worker) Verify(ctx context.Context) error {
+	if err := m.init(ctx); err != nil {
+		return err
+	}
+	var errs Errors
+	err := m.transact(ctx, func(tx *sql.Tx) error {
+		versions, err := m.listVersions(ctx, tx)
+		if err != nil {
+			return err
+		}
+		applied := make(map[VersionID]bool, len(versions))
+		var highest VersionID
+		for _, ver := range versions {
+			applied[ver.ID] = true
+			if ver.ID > highest {
+				highest = ver.ID
+			}
+			if _, ok := m.schema.definitions[ver.ID]; !ok {
+				errs = append(errs, &Error{
+					Version:     ver.ID,
+					Description: "applied version is not defined in the schema",
+				})
+			}
+			if ver.Failed {
+				errs = append(errs, &Error{
+					Version:     ver.ID,
+					Description: "version has failed",
+				})
+			}
+		}
+		for _, plan := range m.schema.plans {
+			if plan.id < highest && !applied[plan.id] {
+				errs = append(errs, &Error{
+					Version:     plan.id,
+					Description: fmt.Sprintf("version is not applied, but later version %d is applied", highest),
+				})
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(errs) > 0 {
+		sort.SliceStable(errs, func(i, j int) bool {
+			return errs[i].Version < errs[j].Version
+		})
+		return errs
+	}
+	return nil
+}
+
+// CheckApplyOrder reports each applied version that was applied earlier
+// than a version with a lower id. Each anomaly refers to the lower version
+// with the latest applied time. No migrations are performed.
+func (m *Worker) CheckApplyOrder(ctx context.Context) ([]OrderAnomaly, error) {
+	if err := m.init(ctx); err != nil {
+		return nil, err
+	}
+	var anomalies []OrderAnomaly
+	err := m.transact(ctx, func(tx *sql.Tx) error {
+		versions, err := m.listVersions(ctx, tx)
+		if err != nil {
+			return err
+		}
+		sort.Slice(versions, func(i, j int) bool {
+			return versions[i].ID < versions[j].ID
+		})
+		var latest *Version
+		for _, ver := range versions {
+			if !ver.Applied || ver.AppliedAt == nil {
+				// the order cannot be checked if the time is not known
+				continue
+			}
+			if latest != nil && ver.AppliedAt.Before(*latest.AppliedAt) {
+				anomalies = append(anomalies, OrderAnomaly{
+					ID:             ver.ID,
+					AppliedAt:      *ver.AppliedAt,
+					LowerID:        latest.ID,
+					LowerAppliedAt: *latest.AppliedAt,
+				})
+				continue
+			}
+			latest = ver
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return anomalies, nil
+}
+
+// Snapshot returns a summary of the database schema versions, which
+// is suitable for polling by monitoring tools.
+func (m *Worker) Snapshot(ctx context.Context) (*Snapshot, error) {
+	if err := m.init(ctx); err != nil {
+		return nil, err
+	}
+	var snapshot Snapshot
+	err := m.transact(ctx, func(tx *sql.Tx) error {
+		versions, err := m.listVersions(ctx, tx)
+		if err != nil {
+			return err
+		}
+		applied := make(map[VersionID]bool)
+		var lastApplied time.Time
+		for _, ver := range versions {
+			applied[ver.ID] = true
+			if ver.ID > snapshot.Version {
+				snapshot.Version = ver.ID
+			}
+			if ver.Failed {
+				snapshot.Failed++
+			}
+			if ver.Locked {
+				snapshot.Locked++
+				if ver.ID > snapshot.LockedVersion {
+					snapshot.LockedVersion = ver.ID
+				}
+			}
+			if ver.AppliedAt != nil && ver.AppliedAt.After(lastApplied) {
+				lastApplied = *ver.AppliedAt
+			}
+		}
+		for _, plan := range m.schema.plans {
+			if !applied[plan.id] {
+				snapshot.Pending++
+			}
+		}
+		if !lastApplied.IsZero() {
+			snapshot.Age = time.Since(lastApplied)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &snapshot, nil
+}
+
+// Lint checks the SQL of every up and down migration in the schema
+// using the ValidateSQL function. Any errors are reported together,
+// and will be of type Errors. Lint does nothing if ValidateSQL is nil.
+func (m *Worker) Lint(ctx context.Context) error {
+	if m.ValidateSQL == nil {
+		return nil
+	}
+	var errs Errors
+	for _, plan := range m.schema.plans {
+		for _, a := range []struct {
+			direction string
+			action    *action
+		}{
+			{"up", &plan.up},
+			{"down", &plan.down},
+		} {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if !a.action.isSQL() {
+				continue
+			}
+			if err := m.ValidateSQL(plan.id, a.direction, a.action.sql); err != nil {
+				errs = append(errs, &Error{
+					Version:     plan.id,
+					Description: fmt.Sprintf("%s: %v", a.direction, err),
+				})
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// WriteMetrics writes metrics describing the database schema versions
+// to w in the Prometheus text exposition format. Each metric has a "table"
+// label containing the name of the migrations table.
+//
+// This is useful for serving metrics from an HTTP handler without needing
+// a metrics client library.
+func (m *Worker) WriteMetrics(ctx context.Context, w io.Writer) error {
+	snapshot, err := m.Snapshot(ctx)
+	if err != nil {
+		return err
+	}
+	metrics := []struct {
+		name  string
+		help  string
+		value int64
+	}{
+		{"current_version", "Highest applied database schema version.", int64(snapshot.Version)},
+		{"pending", "Number of unapplied database schema versions.", int64(snapshot.Pending)},
+		{"failed", "Number of failed database schema versions.", int64(snapshot.Failed)},
+		{"locked", "Number of locked database schema versions.", int64(snapshot.Locked)},
+	}
+	for _, metric := range metrics {
+		name := "schema_migrations_" + metric.name
+		_, err = fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s{table=%q} %d\n",
+			name, metric.help, name, name, m.tableName(ctx), metric.value)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PreviewState reports the database schema versions as they would
+// be after performing the operation op, which is one of "up", "down"
+// or "goto". The id is only used for the "goto" operation.
+//
+// The current state is read from the database once, and the operation
+// is simulated without performing any migrations.
+func (m *Worker) PreviewState(ctx context.Context, op string, id VersionID) ([]*Version, error) {
+	switch op {
+	case "up", "down":
+	case "goto":
+		if id != 0 {
+			if err := m.checkVersion(id); err != nil {
+				return nil, err
+			}
+		}
+	default:
+		return nil, fmt.Errorf("invalid operation: %s", op)
+	}
+	if err := m.init(ctx); err != nil {
+		return nil, err
+	}
+	var versions []*Version
+	err := m.transact(ctx, func(tx *sql.Tx) error {
+		vs, err := m.getVersionSummary(ctx, tx)
+		if err != nil {
+			return err
+		}
+		appliedAt := time.Now()
+		apply := make(map[VersionID]bool)
+		switch op {
+		case "up":
+			for _, plan := range vs.unapplied {
+				apply[plan.id] = true
+			}
+		case "down":
+			for _, plan := range vs.applied {
+				if vs.vmap[plan.id].Locked {
+					break
+				}
+				apply[plan.id] = false
+			}
+		case "goto":
+			if err = vs.checkLocked(id); err != nil {
+				return err
+			}
+			for _, plan := range vs.applied {
+				if plan.id > id {
+					apply[plan.id] = false
+				}
+			}
+			for _, plan := range vs.unapplied {
+				if plan.id <= id {
+					apply[plan.id] = true
+				}
+			}
+		}
+
+		for _, ver := range vs.versions {
+			v := *ver
+			if up, ok := apply[v.ID]; ok {
+				v.Applied = up
+				if up {
+					v.AppliedAt = &appliedAt
+				} else {
+					v.AppliedAt = nil
+					v.Locked = false
+				}
+			}
+			versions = append(versions, &v)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return versions, nil
+}
+
+func (m *Worker) init(ctx context.Context) error {
+	if m.initTables[m.tableName(ctx)] {
+		return nil
+	}
+	var err error
+	if ms := m.schema.MigrationsSchema; ms != "" && !identifierRE.MatchString(ms) {
+		return fmt.Errorf("invalid migrations schema name %q", ms)
+	}
+	if err = m.schema.Columns.check(); err != nil {
+		return err
+	}
+	if m.StateStore == nil {
+		if err = m.drv.CreateMigrationsTable(ctx, m.db, m.tableName(ctx), &m.schema.Columns); err != nil {
+			return err
+		}
+	}
+	if m.RequireEnvironment {
+		err = m.transact(ctx, func(tx *sql.Tx) error {
+			versions, err := m.listVersions(ctx, tx)
+			if err != nil {
+				return err
+			}
+			for _, ver := range versions {
+				if ver.Environment != "" && ver.Environment != m.Environment {
+					return fmt.Errorf("database schema version id=%d applied in environment %q, not %q",
+						ver.ID, ver.Environment, m.Environment)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	// the metadata table is created even if no version has metadata,
+	// so that metadata recorded by an earlier schema is deleted when
+	// its version is migrated down
+	if err = m.drv.CreateMetadataTable(ctx, m.db, m.metaTableName(ctx)); err != nil {
+		return err
+	}
+	if m.initTables == nil {
+		m.initTables = make(map[string]bool)
+	}
+	m.initTables[m.tableName(ctx)] = true
+	return nil
+}
+
+// insertVersion inserts a version record, along with any metadata
+// defined for the version. The checksum of the up migration is recorded
+// so that later changes to the migration can be detected.
+func (m *Worker) insertVersion(ctx context.Context, tx *sql.Tx, plan *migrationPlan, ver *Version) error {
+	ver.Checksum = plan.up.checksum()
+	if err := m.store(ctx).InsertVersion(ctx, tx, ver); err != nil {
+		return err
+	}
+	if len(plan.meta) > 0 {
+		return m.drv.InsertMetadata(ctx, tx, m.metaTableName(ctx), ver.ID, plan.meta)
+	}
+	return nil
+}
+
+// deleteVersion deletes a version record, along with any metadata
+// recorded for the version.
+func (m *Worker) deleteVersion(ctx context.Context, tx *sql.Tx, id VersionID) error {
+	if err := m.store(ctx).DeleteVersion(ctx, tx, id); err != nil {
+		return err
+	}
+	return m.drv.DeleteMetadata(ctx, tx, m.metaTableName(ctx), id)
+}
+
+// confirm calls the Confirm function, if any, with the migration
+// steps required to perform the operation op, and reports whether
+// the operation should proceed.
+func (m *Worker) confirm(ctx context.Context, op string, id VersionID) (bool, error) {
+	if m.Confirm == nil {
+		return true, nil
+	}
+	var steps []*PlannedStep
+	err := m.transact(ctx, func(tx *sql.Tx) error {
+		vs, err := m.getVersionSummary(ctx, tx)
+		if err != nil {
+			return err
+		}
+		steps = vs.steps(op, id)
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+	if len(steps) == 0 {
+		return true, nil
+	}
+	ok, err := m.Confirm(steps)
+	if err != nil {
+		return false, err
+	}
+	if !ok {
+		m.log(fmt.Sprintf("migrate %s not confirmed", op))
+	}
+	return ok, nil
+}
+
+// checkNothingToDo returns ErrNothingToDo if the operation op would not
+// perform any migrations and the worker is configured to report this.
+func (m *Worker) checkNothingToDo(ctx context.Context, op string, id VersionID) error {
+	if !m.ErrorOnNoop {
+		return nil
+	}
+	return m.transact(ctx, func(tx *sql.Tx) error {
+		vs, err := m.getVersionSummary(ctx, tx)
+		if err != nil {
+			return err
+		}
+		var count int
+		switch op {
+		case "up":
+			count = len(vs.unapplied)
+		case "down":
+			if len(vs.applied) > 0 && !vs.vmap[vs.applied[0].id].Locked {
+				count = 1
+			}
+		case "force down":
+			count = len(vs.applied)
+		case "goto":
+			for _, plan := range vs.applied {
+				if plan.id > id {
+					count++
+				}
+			}
+			for _, plan := range vs.unapplied {
+				if plan.id <= id {
+					count++
+				}
+			}
+		}
+		if count == 0 {
+			return ErrNothingToDo
+		}
+		return nil
+	})
+}
+
+func (m *Worker) log(args ...interface{}) {
+	if m.LogFunc != nil {
+		m.LogFunc(args...)
+	}
+}
+
+// migrationStarted notifies the worker's Logger, if any, that the
+// migration of version id in direction dir is starting, and returns
+// the start time.
+func (m *Worker) migrationStarted(id VersionID, dir string) time.Time {
+	if m.Logger != nil {
+		m.Logger.MigrationStarted(id, dir)
+	}
+	return time.Now()
+}
+
+// migrationFinished notifies the worker's Logger that a migration has
+// finished. If the worker has no Logger, a successful migration is
+// logged using LogFunc.
+func (m *Worker) migrationFinished(id VersionID, dir string, start time.Time, err error) {
+	if m.Logger != nil {
+		m.Logger.MigrationFinished(id, time.Since(start), err)
+		return
+	}
+	if err == nil {
+		m.log(fmt.Sprintf("migrated %s version=%d", dir, id))
+	}
+}
+
+func (m *Worker) finished(ctx context.Context, msg string) error {
+	return m.transact(ctx, func(tx *sql.Tx) error {
+		vs, err := m.getVersionSummaryAllowFailed(ctx, tx)
+		if err != nil {
+			return err
+		}
+		summary := &Summary{Message: msg}
+		if len(vs.applied) > 0 {
+			plan := vs.applied[0]
+			version := vs.vmap[plan.id]
+			summary.Version = version.ID
+			summary.Locked = version.Locked
+			summary.Failed = version.Failed
+		}
+		for _, plan := range vs.applied {
+			version := vs.vmap[plan.id]
+			if version.Locked {
+				summary.LockedCount++
+			}
+			if version.Failed {
+				summary.FailedCount++
+			}
+		}
+		m.lastSummary = summary
+		if m.SuppressFinishedLog {
+			return nil
+		}
+		args := []interface{}{msg, fmt.Sprintf("version=%d", summary.Version)}
+		if summary.Locked {
+			args = append(args, "status=locked")
+		}
+		if summary.Failed {
+			args = append(args, "status=failed")
+		}
+		if summary.LockedCount > 0 || summary.FailedCount > 0 {
+			args = append(args,
+				fmt.Sprintf("locked=%d", summary.LockedCount),
+				fmt.Sprintf("failed=%d", summary.FailedCount),
+			)
+		}
+		m.log(args...)
+		return nil
+	})
+}
+
+// checkContext returns an error if ctx is already done, so that
+// the operation op fails before accessing the database.
+func checkContext(ctx context.Context, op string) error {
+	if err := ctx.Err(); err != nil {
+		return wrapf(err, "cannot %s", op)
+	}
+	return nil
+}
+
+// advisoryLock acquires the database advisory lock for the migrations
+// table, and returns a function that releases it.
+func (m *Worker) advisoryLock(ctx context.Context) (release func(), err error) {
+	key := m.tableName(ctx)
+	conn, err := m.drv.AdvisoryLock(ctx, m.db, key)
+	if err != nil {
+		return nil, err
+	}
+	release = func() {
+		// release the lock even if ctx has been canceled
+		if err := m.drv.AdvisoryUnlock(context.Background(), conn, key); err != nil {
+			m.log(err)
+		}
+	}
+	return release, nil
+}
+
+// beginRun records the highest applied version at the start of an
+// operation, for reporting to the OnComplete function.
+func (m *Worker) beginRun(ctx context.Context) error {
+	m.runFrom = 0
+	m.runChanged = nil
+	if m.OnComplete == nil {
+		return nil
+	}
+	return m.transact(ctx, func(tx *sql.Tx) error {
+		vs, err := m.getVersionSummaryAllowFailed(ctx, tx)
+		if err != nil {
+			return err
+		}
+		if len(vs.applied) > 0 {
+			m.runFrom = vs.applied[0].id
+		}
+		return nil
+	})
+}
+
+// completeRun calls the OnComplete function, if any, at the end
+// of a successful operation.
+func (m *Worker) completeRun(op string) {
+	if m.OnComplete == nil {
+		return
+	}
+	result := &RunResult{
+		From:    m.runFrom,
+		Changed: m.runChanged,
+	}
+	if m.lastSummary != nil {
+		result.To = m.lastSummary.Version
+	}
+	m.OnComplete(op, result)
+}
+
+// LastSummary returns a summary of the database schema version at the
+// end of the most recent successful operation performed by the worker,
+// or nil if no operation has completed.
+func (m *Worker) LastSummary() *Summary {
+	return m.lastSummary
+}
+
+// transact calls fn in a transaction, which is committed if fn succeeds.
+// The transaction is not retried, so fn may accumulate results in
+// variables declared outside it.
+func (m *Worker) transact(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return wrapf(err, "cannot begin tx")
+	}
+	return commitTx(tx, fn)
+}
+
+// txAttempts is the number of times that a transaction is attempted
+// when it fails with an error that the driver reports as retryable.
+const txAttempts = 5
+
+// retryTx calls attempt, which performs a transaction, and calls it
+// again if it fails with an error that the driver reports as retryable,
+// such as a serialization failure.
+func (m *Worker) retryTx(ctx context.Context, attempt func() error) error {
+	for n := 1; ; n++ {
+		err := attempt()
+		if err == nil || n >= txAttempts || !m.drv.IsRetryable(err) {
+			return err
+		}
+		m.log(fmt.Sprintf("retrying transaction: %v", err))
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(time.Duration(n) * 50 * time.Millisecond):
+		}
+	}
+}
+
+// migrationTx is like transact, but is used for transactions that
+// perform migrations. If the worker has a session initialization
+// function or a lock timeout, the connection is initialized before
+// the transaction begins. The transaction is retried if it fails with
+// a retryable error, so fn must reset any state that it sets outside
+// the transaction before it does anything else.
+func (m *Worker) migrationTx(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	return m.retryTx(ctx, func() error {
+		if !m.needsSession() {
+			return m.transact(ctx, fn)
+		}
+		conn, err := m.sessionConn(ctx)
+		if err != nil {
+			return err
 		}
+		defer m.releaseConn(ctx, conn)
+		tx, err := conn.BeginTx(ctx, nil)
+		if err != nil {
+			return wrapf(err, "cannot begin tx")
+		}
+		return commitTx(tx, fn)
+	})
+}
 
-		return m.drv.SetVersionLocked(ctx, tx, m.tableName(), id, lock)
-	})
-	if err != nil {
-		return err
+// needsSession reports whether migrations need to be performed
+// on a connection that has been initialized by sessionConn.
+func (m *Worker) needsSession() bool {
+	if m.SessionInit != nil || m.sqliteForeignKeysSQL() != "" {
+		return true
 	}
-
-	m.log(fmt.Sprintf("%s version=%d", verb, id))
-
-	return nil
+	if m.LockTimeoutSQL > 0 {
+		set, _ := m.drv.LockTimeoutSQL(m.LockTimeoutSQL)
+		return set != ""
+	}
+	return false
 }
 
-// Goto migrates up or down to the specified version.
-//
-// If id is zero, then all down migrations are applied
-// to result in an empty database.
-func (m *Worker) Goto(ctx context.Context, id VersionID) error {
-	// id=0 is a special case, remove all migrations
-	if id != 0 {
-		if err := m.checkVersion(id); err != nil {
-			return err
-		}
+// sessionConn returns a database connection that has been initialized
+// using the worker's lock timeout and session initialization function.
+// The connection should be released using releaseConn.
+func (m *Worker) sessionConn(ctx context.Context) (*sql.Conn, error) {
+	conn, err := m.db.Conn(ctx)
+	if err != nil {
+		return nil, wrapf(err, "cannot get connection")
 	}
-	if err := m.init(ctx); err != nil {
-		return err
+	if m.LockTimeoutSQL > 0 {
+		if set, _ := m.drv.LockTimeoutSQL(m.LockTimeoutSQL); set != "" {
+			if _, err = conn.ExecContext(ctx, set); err != nil {
+				// cannot report an error closing the connection
+				conn.Close()
+				return nil, wrapf(err, "cannot set lock timeout")
+			}
+		}
 	}
-	for {
-		more, err := m.gotoOne(ctx, id)
-		if err != nil {
-			return err
+	if pragma := m.sqliteForeignKeysSQL(); pragma != "" {
+		if _, err = conn.ExecContext(ctx, pragma); err != nil {
+			m.releaseConn(ctx, conn)
+			return nil, wrapf(err, "cannot set foreign keys")
 		}
-		if !more {
-			m.finished(ctx, "migrate goto finished")
-			break
+	}
+	if m.SessionInit != nil {
+		if err = m.SessionInit(ctx, conn); err != nil {
+			// cannot report an error closing the connection
+			m.releaseConn(ctx, conn)
+			return nil, wrapf(err, "cannot initialize session")
 		}
 	}
-	return nil
+	return conn, nil
 }
 
-// Versions lists all of the database schema versions.
-func (m *Worker) Versions(ctx context.Context) ([]*Version, error) {
-	var versions []*Version
-	if err := m.init(ctx); err != nil {
-		return versions, err
+// sqliteForeignKeysSQL returns the pragma that sets foreign key
+// enforcement for SQLite, or a blank string if it is not required.
+func (m *Worker) sqliteForeignKeysSQL() string {
+	if m.SQLiteForeignKeys == nil || m.drv.Dialect() != "sqlite" {
+		return ""
 	}
-	err := m.transact(ctx, func(tx *sql.Tx) error {
-		vs, err := m.getVersionSummaryAllowFailed(ctx, tx)
-		if err != nil {
-			return err
+	if *m.SQLiteForeignKeys {
+		return "pragma foreign_keys = on"
+	}
+	return "pragma foreign_keys = off"
+}
+
+// releaseConn restores the lock timeout of a connection obtained
+// from sessionConn before returning it to the connection pool.
+func (m *Worker) releaseConn(ctx context.Context, conn *sql.Conn) {
+	if m.LockTimeoutSQL > 0 {
+		if _, reset := m.drv.LockTimeoutSQL(m.LockTimeoutSQL); reset != "" {
+			// cannot report an error resetting the lock timeout
+			conn.ExecContext(ctx, reset)
 		}
-		versions = vs.versions
+	}
+	// cannot report an error closing the connection
+	conn.Close()
+}
 
-		return nil
-	})
-	return versions, err
+// applyNoTx applies an SQL migration outside of a transaction, using
+// the external apply function if the migration has one.
+func (m *Worker) applyNoTx(ctx context.Context, a *action) error {
+	if a.external != nil {
+		return a.external(ctx, a.sql)
+	}
+	return m.execNoTx(ctx, a.sql)
 }
 
-func (m *Worker) init(ctx context.Context) error {
-	if m.initCalled {
-		return nil
+// sqlSnippetLen is the maximum length of the SQL included in an error.
+const sqlSnippetLen = 200
+
+// wrapSQL wraps an error returned by the SQL migration for version id,
+// including the start of the SQL in the message unless the worker is
+// configured to redact it.
+func (m *Worker) wrapSQL(err error, id VersionID, query string) error {
+	if m.RedactSQLInErrors {
+		return wrapf(err, "%d", id)
+	}
+	snippet := strings.Join(strings.Fields(query), " ")
+	if len(snippet) > sqlSnippetLen {
+		snippet = snippet[:sqlSnippetLen] + "..."
+	}
+	return wrapf(err, "%d: %s", id, snippet)
+}
+
+// execNoTx executes an SQL migration outside of a transaction.
+func (m *Worker) execNoTx(ctx context.Context, query string) error {
+	if !m.needsSession() {
+		return m.execSQL(ctx, m.db, query)
 	}
-	err := m.drv.CreateMigrationsTable(ctx, m.db, m.tableName())
+	conn, err := m.sessionConn(ctx)
 	if err != nil {
 		return err
 	}
-	m.initCalled = true
-	return nil
+	defer m.releaseConn(ctx, conn)
+	return m.execSQL(ctx, conn, query)
 }
 
-func (m *Worker) log(args ...interface{}) {
-	if m.LogFunc != nil {
-		m.LogFunc(args...)
-	}
+// execer is implemented by *sql.DB, *sql.Conn and *sql.Tx.
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
 }
 
-func (m *Worker) finished(ctx context.Context, msg string) error {
-	return m.transact(ctx, func(tx *sql.Tx) error {
-		vs, err := m.getVersionSummaryAllowFailed(ctx, tx)
-		if err != nil {
+// execSQL executes the SQL for a migration, one statement at a time
+// if the worker is configured to split statements.
+func (m *Worker) execSQL(ctx context.Context, e execer, query string) error {
+	if !m.SplitStatements {
+		_, err := e.ExecContext(ctx, query)
+		return err
+	}
+	for _, stmt := range splitStatements(query) {
+		if _, err := e.ExecContext(ctx, stmt); err != nil {
 			return err
 		}
-		args := []interface{}{msg}
-		if len(vs.applied) > 0 {
-			plan := vs.applied[0]
-			version := vs.vmap[plan.id]
-			args = append(args, fmt.Sprintf("version=%d", version.ID))
-			if version.Locked {
-				args = append(args, "status=locked")
-			}
-			if version.Failed {
-				args = append(args, "status=failed")
-			}
-		} else {
-			args = append(args, "version=0")
-		}
-		m.log(args...)
-		return nil
-	})
-}
-
-func (m *Worker) transact(ctx context.Context, fn func(tx *sql.Tx) error) error {
-	tx, err := m.db.BeginTx(ctx, nil)
-	if err != nil {
-		return wrapf(err, "cannot begin tx")
 	}
+	return nil
+}
 
+func commitTx(tx *sql.Tx, fn func(tx *sql.Tx) error) error {
+	var err error
 	if err = fn(tx); err != nil {
 		// cannot report an error rolling back
 		tx.Rollback()
@@ -370,7 +2248,7 @@ func (m *Worker) gotoOne(ctx context.Context, id VersionID) (more bool, err erro
 	}
 
 	if downCount > 0 {
-		if _, err = m.downOne(ctx); err != nil {
+		if _, err = m.downOne(ctx, false); err != nil {
 			return false, err
 		}
 		downCount--
@@ -390,11 +2268,21 @@ func (m *Worker) gotoOne(ctx context.Context, id VersionID) (more bool, err erro
 // false otherwise.
 func (m *Worker) upOne(ctx context.Context) (more bool, err error) {
 	var (
-		noTx bool
-		id   VersionID
+		noTx      bool
+		id        VersionID
+		failedID  VersionID
+		startedID VersionID
+		start     time.Time
 	)
 
-	err = m.transact(ctx, func(tx *sql.Tx) error {
+	enabledID, enabled, err := m.checkEnabled(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	err = m.migrationTx(ctx, func(tx *sql.Tx) error {
+		// reset in case the transaction is retried
+		noTx, failedID, startedID = false, 0, 0
 		vs, err := m.getVersionSummary(ctx, tx)
 		if err != nil {
 			return err
@@ -410,14 +2298,42 @@ func (m *Worker) upOne(ctx context.Context) (more bool, err error) {
 		appliedAt := time.Now()
 		more = len(vs.unapplied) > 1
 
+		if plan.enabled != nil {
+			if plan.id != enabledID {
+				return fmt.Errorf("cannot migrate up version id=%d: database changed while checking whether it is enabled", plan.id)
+			}
+			if !enabled {
+				version := &Version{
+					ID:          plan.id,
+					AppliedAt:   &appliedAt,
+					Locked:      m.AutoLock,
+					Skipped:     true,
+					Environment: m.Environment,
+					AppliedBy:   m.appliedBy(),
+				}
+				if err = m.insertVersion(ctx, tx, plan, version); err != nil {
+					return wrapf(err, "%d", plan.id)
+				}
+				m.log(fmt.Sprintf("skipped up version=%d", plan.id))
+				return nil
+			}
+		}
+
+		actx, cancel := plan.actionContext(ctx)
+		defer cancel()
 		if upTx := plan.up.txFunc; upTx != nil {
 			// Regardless of whether the driver supports transactional
 			// migrations, this migration uses a transaction.
-			if err = upTx(ctx, tx); err != nil {
-				return wrapf(err, "%d", plan.id)
+			startedID, start = plan.id, m.migrationStarted(plan.id, "up")
+			if err = m.eachHook(ctx, tx, plan.id, "before", m.BeforeEach); err != nil {
+				return err
+			}
+			if err = upTx(actx, tx); err != nil {
+				failedID = plan.id
+				return wrapf(plan.timeoutErr(ctx, actx, err), "%d", plan.id)
 			}
 		} else {
-			if !m.drv.SupportsTransactionalDDL() || plan.up.dbFunc != nil {
+			if !m.drv.SupportsTransactionalDDL() || plan.up.dbFunc != nil || plan.up.batch != nil || plan.up.external != nil {
 				// Either the driver does not support transactional
 				// DDL, or the up migration has been specified using
 				// a non-transactional function.
@@ -425,42 +2341,140 @@ func (m *Worker) upOne(ctx context.Context) (more bool, err error) {
 				noTx = true
 				return nil
 			}
-			_, err = tx.ExecContext(ctx, plan.up.sql)
+			startedID, start = plan.id, m.migrationStarted(plan.id, "up")
+			if err = m.eachHook(ctx, tx, plan.id, "before", m.BeforeEach); err != nil {
+				return err
+			}
+			err = m.execSQL(actx, tx, plan.up.sql)
 			if err != nil {
-				return wrapf(err, "%d", plan.id)
+				failedID = plan.id
+				return m.wrapSQL(plan.timeoutErr(ctx, actx, err), plan.id, plan.up.sql)
 			}
 		}
+		if err = m.eachHook(ctx, tx, plan.id, "after", m.AfterEach); err != nil {
+			return err
+		}
 
 		// At this point the migration has been performed in a transaction,
 		// so update the schema migrations table.
 		version := &Version{
-			ID:        plan.id,
-			AppliedAt: &appliedAt,
+			ID:          plan.id,
+			AppliedAt:   &appliedAt,
+			Locked:      m.AutoLock,
+			Environment: m.Environment,
+			AppliedBy:   m.appliedBy(),
+			Duration:    time.Since(start),
 		}
 
-		if err = m.drv.InsertVersion(ctx, tx, m.tableName(), version); err != nil {
+		if err = m.insertVersion(ctx, tx, plan, version); err != nil {
 			return wrapf(err, "%d", plan.id)
 		}
 
-		m.log(fmt.Sprintf("migrated up version=%d", plan.id))
-
 		return nil
 	})
+	if startedID != 0 {
+		m.migrationFinished(startedID, "up", start, err)
+	}
 	if err != nil {
+		if failedID != 0 && m.RecordTransactionalFailures {
+			m.recordFailure(ctx, failedID, true)
+		}
 		return more, err
 	}
+	if startedID != 0 {
+		m.runChanged = append(m.runChanged, startedID)
+	}
 
 	if noTx {
 		// The migration needs to be performed outside of a transaction
-		if err = m.upOneNoTx(ctx, id); err != nil {
+		start = m.migrationStarted(id, "up")
+		err = m.upOneNoTx(ctx, id)
+		m.migrationFinished(id, "up", start, err)
+		if err != nil {
 			return more, err
 		}
-		m.log(fmt.Sprintf("migrated up version=%d", id))
+		m.runChanged = append(m.runChanged, id)
 	}
 
 	return more, nil
 }
 
+// checkEnabled calls the Enabled function of the next version to be
+// migrated up, if it has one, and returns the version id and whether its
+// migration is enabled. The function is passed the database, so it is
+// called before the migration transaction begins: inside the transaction,
+// its queries would wait for a second connection, which never becomes
+// available if the pool is limited to one.
+func (m *Worker) checkEnabled(ctx context.Context) (id VersionID, enabled bool, err error) {
+	var plan *migrationPlan
+	for _, p := range m.schema.plans {
+		if p.enabled != nil {
+			plan = p
+			break
+		}
+	}
+	if plan == nil {
+		// no version has an Enabled function
+		return 0, true, nil
+	}
+	err = m.transact(ctx, func(tx *sql.Tx) error {
+		vs, err := m.getVersionSummary(ctx, tx)
+		if err != nil {
+			return err
+		}
+		plan = nil
+		if len(vs.unapplied) > 0 {
+			plan = vs.unapplied[0]
+		}
+		return nil
+	})
+	if err != nil || plan == nil || plan.enabled == nil {
+		return 0, true, err
+	}
+	if enabled, err = plan.enabled(ctx, m.db); err != nil {
+		return 0, false, wrapf(err, "%d", plan.id)
+	}
+	return plan.id, enabled, nil
+}
+
+// eachHook calls the BeforeEach or AfterEach function hook, if not nil,
+// for the migration of version id in transaction tx.
+func (m *Worker) eachHook(ctx context.Context, tx *sql.Tx, id VersionID, when string, hook func(context.Context, *sql.Tx, VersionID) error) error {
+	if hook == nil {
+		return nil
+	}
+	if err := hook(ctx, tx, id); err != nil {
+		return wrapf(err, "%d: %s migration", id, when)
+	}
+	return nil
+}
+
+// recordFailure marks a version as failed after its transactional
+// migration has been rolled back. If the failed migration was an up
+// migration, a version record is inserted with the failed status.
+func (m *Worker) recordFailure(ctx context.Context, id VersionID, up bool) {
+	err := m.transact(ctx, func(tx *sql.Tx) error {
+		if up {
+			now := time.Now()
+			ver := &Version{
+				ID:          id,
+				AppliedAt:   &now,
+				Failed:      true,
+				Environment: m.Environment,
+				AppliedBy:   m.appliedBy(),
+			}
+			return m.store(ctx).InsertVersion(ctx, tx, ver)
+		}
+		return m.store(ctx).SetFailed(ctx, tx, id, true)
+	})
+	if err != nil {
+		// the migration error is more important, so just log this one
+		m.log(fmt.Sprintf("cannot record failure version=%d: %v", id, err))
+		return
+	}
+	m.log(fmt.Sprintf("recorded failure version=%d", id))
+}
+
 func (m *Worker) upOneNoTx(ctx context.Context, id VersionID) error {
 	var (
 		err  error
@@ -478,33 +2492,66 @@ func (m *Worker) upOneNoTx(ctx context.Context, id VersionID) error {
 	}
 
 	// create version record with failed status
+	now := time.Now()
+	ver := &Version{
+		ID:          id,
+		AppliedAt:   &now,
+		Failed:      true,
+		Environment: m.Environment,
+		AppliedBy:   m.appliedBy(),
+		Checksum:    plan.up.checksum(),
+	}
 	err = m.transact(ctx, func(tx *sql.Tx) error {
-		now := time.Now()
-		ver := &Version{
-			ID:        id,
-			AppliedAt: &now,
-			Failed:    true,
+		// replace any failed version record when called by Retry
+		if err := m.store(ctx).DeleteVersion(ctx, tx, id); err != nil {
+			return err
 		}
-		return m.drv.InsertVersion(ctx, tx, m.tableName(), ver)
+		return m.store(ctx).InsertVersion(ctx, tx, ver)
 	})
 	if err != nil {
 		return err
 	}
 
-	if upDB := plan.up.dbFunc; upDB != nil {
-		if err = upDB(ctx, m.db); err != nil {
-			return wrapf(err, "%d", id)
+	actx, cancel := plan.actionContext(ctx)
+	defer cancel()
+	if upTx := plan.up.txFunc; upTx != nil {
+		// only when called by Retry, as upOne runs these in its transaction
+		err = m.transact(actx, func(tx *sql.Tx) error {
+			return upTx(actx, tx)
+		})
+		if err != nil {
+			return wrapf(plan.timeoutErr(ctx, actx, err), "%d", id)
+		}
+	} else if upDB := plan.up.dbFunc; upDB != nil {
+		if err = upDB(actx, m.db); err != nil {
+			return wrapf(plan.timeoutErr(ctx, actx, err), "%d", id)
+		}
+	} else if batch := plan.up.batch; batch != nil {
+		if err = m.runBatches(actx, id, batch); err != nil {
+			return wrapf(plan.timeoutErr(ctx, actx, err), "%d", id)
 		}
 	} else {
-		_, err = m.db.ExecContext(ctx, plan.up.sql)
-		if err != nil {
-			return wrapf(err, "%d", id)
+		if err = m.applyNoTx(actx, &plan.up); err != nil {
+			return m.wrapSQL(plan.timeoutErr(ctx, actx, err), id, plan.up.sql)
 		}
 	}
 
-	// success, mark transaction as successful
+	// success, so replace the version record with one that is not
+	// failed, and which records the time taken
+	ver.Failed = false
+	ver.Locked = m.AutoLock
+	ver.Duration = time.Since(now)
 	err = m.transact(ctx, func(tx *sql.Tx) error {
-		return m.drv.SetVersionFailed(ctx, tx, m.tableName(), id, false)
+		if len(plan.meta) > 0 {
+			err := m.drv.InsertMetadata(ctx, tx, m.metaTableName(ctx), id, plan.meta)
+			if err != nil {
+				return err
+			}
+		}
+		if err := m.store(ctx).DeleteVersion(ctx, tx, id); err != nil {
+			return err
+		}
+		return m.store(ctx).InsertVersion(ctx, tx, ver)
 	})
 	if err != nil {
 		return err
@@ -516,47 +2563,86 @@ func (m *Worker) upOneNoTx(ctx context.Context, id VersionID) error {
 // downOne migrates down one version using a transaction if possible.
 // Reports true if there is another down migration available,
 // false otherwise.
-func (m *Worker) downOne(ctx context.Context) (more bool, err error) {
+func (m *Worker) downOne(ctx context.Context, force bool) (more bool, err error) {
+	return m.downVersion(ctx, 0, force)
+}
+
+// downVersion migrates down the applied version target, or the highest
+// applied version if target is zero. A locked version is only migrated
+// down if force is true. Reports true if there is another down migration
+// available, false otherwise.
+func (m *Worker) downVersion(ctx context.Context, target VersionID, force bool) (more bool, err error) {
 	var (
-		noTx bool
-		id   VersionID
+		noTx      bool
+		id        VersionID
+		failedID  VersionID
+		startedID VersionID
+		start     time.Time
 	)
 
-	err = m.transact(ctx, func(tx *sql.Tx) error {
+	err = m.migrationTx(ctx, func(tx *sql.Tx) error {
+		// reset in case the transaction is retried
+		noTx, failedID, startedID = false, 0, 0
 		vs, err := m.getVersionSummary(ctx, tx)
 		if err != nil {
 			return err
 		}
 
-		if len(vs.applied) == 0 {
+		if len(vs.applied) == 0 && target == 0 {
 			return nil
 		}
 
 		// the applied plan that will be reversed
-		plan := vs.applied[0]
-		var version *Version
-		for _, ver := range vs.versions {
-			if ver.ID == plan.id {
-				version = ver
-				break
+		var plan *migrationPlan
+		if target == 0 {
+			plan = vs.applied[0]
+		} else {
+			for _, p := range vs.applied {
+				if p.id == target {
+					plan = p
+					break
+				}
+			}
+			if plan == nil {
+				return fmt.Errorf("cannot revert unapplied version id=%d", target)
 			}
 		}
+		version := vs.vmap[plan.id]
 
-		if version.Locked {
-			m.log(fmt.Sprintf("locked version=%d", version.ID))
-			return nil
+		if cp := m.schema.checkpoint; cp != nil && plan.id <= cp.id {
+			return fmt.Errorf("cannot migrate down version id=%d: replaced by checkpoint id=%d", plan.id, cp.id)
+		}
+
+		if version.Locked && !force {
+			return versionError{Err: ErrVersionLocked, ID: version.ID}
 		}
 
 		more = len(vs.applied) > 1
 
+		if version.Skipped {
+			// the up migration was not performed, so neither is the down migration
+			if err = m.deleteVersion(ctx, tx, version.ID); err != nil {
+				return wrapf(err, "%d", plan.id)
+			}
+			m.log(fmt.Sprintf("skipped down version=%d", plan.id))
+			return nil
+		}
+
+		actx, cancel := plan.actionContext(ctx)
+		defer cancel()
 		if downTx := plan.down.txFunc; downTx != nil {
 			// Regardless of whether the driver supports transactional
 			// migrations, this migration uses a transaction.
-			if err = downTx(ctx, tx); err != nil {
-				return wrapf(err, "%d", plan.id)
+			startedID, start = plan.id, m.migrationStarted(plan.id, "down")
+			if err = m.eachHook(ctx, tx, plan.id, "before", m.BeforeEach); err != nil {
+				return err
+			}
+			if err = downTx(actx, tx); err != nil {
+				failedID = plan.id
+				return wrapf(plan.timeoutErr(ctx, actx, err), "%d", plan.id)
 			}
 		} else {
-			if !m.drv.SupportsTransactionalDDL() || plan.down.dbFunc != nil {
+			if !m.drv.SupportsTransactionalDDL() || plan.down.dbFunc != nil || plan.down.batch != nil || plan.down.external != nil {
 				// Either the driver does not support transactional
 				// DDL, or the up migration has been specified using
 				// a non-transactional function.
@@ -564,31 +2650,50 @@ func (m *Worker) downOne(ctx context.Context) (more bool, err error) {
 				noTx = true
 				return nil
 			}
-			_, err = tx.ExecContext(ctx, plan.down.sql)
+			startedID, start = plan.id, m.migrationStarted(plan.id, "down")
+			if err = m.eachHook(ctx, tx, plan.id, "before", m.BeforeEach); err != nil {
+				return err
+			}
+			err = m.execSQL(actx, tx, plan.down.sql)
 			if err != nil {
-				return wrapf(err, "%d", plan.id)
+				failedID = plan.id
+				return m.wrapSQL(plan.timeoutErr(ctx, actx, err), plan.id, plan.down.sql)
 			}
 		}
+		if err = m.eachHook(ctx, tx, plan.id, "after", m.AfterEach); err != nil {
+			return err
+		}
 
 		// At this point the migration has been performed in a transaction,
 		// so update the schema migrations table.
-		if err = m.drv.DeleteVersion(ctx, tx, m.tableName(), version.ID); err != nil {
+		if err = m.deleteVersion(ctx, tx, version.ID); err != nil {
 			return wrapf(err, "%d", plan.id)
 		}
-		m.log(fmt.Sprintf("migrated down version=%d", plan.id))
 
 		return nil
 	})
+	if startedID != 0 {
+		m.migrationFinished(startedID, "down", start, err)
+	}
 	if err != nil {
+		if failedID != 0 && m.RecordTransactionalFailures {
+			m.recordFailure(ctx, failedID, false)
+		}
 		return more, err
 	}
+	if startedID != 0 {
+		m.runChanged = append(m.runChanged, startedID)
+	}
 
 	if noTx {
 		// The migration needs to be performed outside of a transaction
-		if err = m.downOneNoTx(ctx, id); err != nil {
+		start = m.migrationStarted(id, "down")
+		err = m.downOneNoTx(ctx, id)
+		m.migrationFinished(id, "down", start, err)
+		if err != nil {
 			return false, err
 		}
-		m.log(fmt.Sprintf("migrated down version=%d", id))
+		m.runChanged = append(m.runChanged, id)
 	}
 	return more, err
 }
@@ -611,26 +2716,31 @@ func (m *Worker) downOneNoTx(ctx context.Context, id VersionID) error {
 
 	// mark version as failed
 	err = m.transact(ctx, func(tx *sql.Tx) error {
-		return m.drv.SetVersionFailed(ctx, tx, m.tableName(), id, false)
+		return m.store(ctx).SetFailed(ctx, tx, id, false)
 	})
 	if err != nil {
 		return err
 	}
 
+	actx, cancel := plan.actionContext(ctx)
+	defer cancel()
 	if downDB := plan.down.dbFunc; downDB != nil {
-		if err = downDB(ctx, m.db); err != nil {
-			return wrapf(err, "%d", id)
+		if err = downDB(actx, m.db); err != nil {
+			return wrapf(plan.timeoutErr(ctx, actx, err), "%d", id)
+		}
+	} else if batch := plan.down.batch; batch != nil {
+		if err = m.runBatches(actx, id, batch); err != nil {
+			return wrapf(plan.timeoutErr(ctx, actx, err), "%d", id)
 		}
 	} else {
-		_, err = m.db.ExecContext(ctx, plan.down.sql)
-		if err != nil {
-			return wrapf(err, "%d", id)
+		if err = m.applyNoTx(actx, &plan.down); err != nil {
+			return m.wrapSQL(plan.timeoutErr(ctx, actx, err), id, plan.down.sql)
 		}
 	}
 
 	// success, so delete version record
 	err = m.transact(ctx, func(tx *sql.Tx) error {
-		return m.drv.DeleteVersion(ctx, tx, m.tableName(), id)
+		return m.deleteVersion(ctx, tx, id)
 	})
 	if err != nil {
 		return err
@@ -639,21 +2749,119 @@ func (m *Worker) downOneNoTx(ctx context.Context, id VersionID) error {
 	return nil
 }
 
+// runBatches performs a batch action, each batch in its own transaction,
+// until a batch affects no rows.
+func (m *Worker) runBatches(ctx context.Context, id VersionID, batch *batchAction) error {
+	var offset int
+	for {
+		var affected int
+		err := m.migrationTx(ctx, func(tx *sql.Tx) error {
+			if batch.fn != nil {
+				n, err := batch.fn(ctx, tx, offset)
+				affected = n
+				return err
+			}
+			result, err := tx.ExecContext(ctx, batch.query, batch.size)
+			if err != nil {
+				return err
+			}
+			n, err := result.RowsAffected()
+			affected = int(n)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		if affected == 0 {
+			return nil
+		}
+		offset += affected
+		m.log(fmt.Sprintf("batch version=%d rows=%d", id, offset))
+	}
+}
+
+// store returns the worker's state store, which defaults to
+// the migrations table.
+func (m *Worker) store(ctx context.Context) StateStore {
+	if m.StateStore != nil {
+		return m.StateStore
+	}
+	return &tableStore{drv: m.drv, tblname: m.tableName(ctx), cols: &m.schema.Columns}
+}
+
 func (m *Worker) listVersions(ctx context.Context, tx *sql.Tx) ([]*Version, error) {
-	return m.drv.ListVersions(ctx, tx, m.tableName())
+	versions, err := m.store(ctx).ListVersions(ctx, tx)
+	if err != nil {
+		return nil, err
+	}
+	for _, ver := range versions {
+		// every version in the store has been applied, even
+		// if the time that it was applied is not known
+		ver.Applied = true
+		if ver.Warning != "" && !m.warned[ver.ID] {
+			// only warn once for each version
+			if m.warned == nil {
+				m.warned = make(map[VersionID]bool)
+			}
+			m.warned[ver.ID] = true
+			m.log(fmt.Sprintf("warning: database schema version id=%d: %s", ver.ID, ver.Warning))
+		}
+	}
+	return versions, nil
 }
 
-func (m *Worker) tableName() string {
+// tableName returns the name of the migrations table, which is
+// resolved using the context if the worker has a TableNameFunc.
+func (m *Worker) tableName(ctx context.Context) string {
+	if m.TableNameFunc != nil {
+		if tn := m.TableNameFunc(ctx); tn != "" {
+			return tn
+		}
+	}
 	tn := m.schema.MigrationsTable
 	if tn == "" {
 		tn = DefaultMigrationsTable
 	}
+	if m.schema.MigrationsSchema != "" && !strings.Contains(tn, ".") {
+		tn = m.schema.MigrationsSchema + "." + tn
+	}
 	return tn
 }
 
+// identifierRE matches a database identifier that is safe to use in
+// SQL statements without quoting.
+var identifierRE = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// runsTableName returns the name of the table of completed run IDs,
+// which is derived from the migrations table name, so that tenants with
+// separate migrations tables do not share run IDs.
+func (m *Worker) runsTableName(ctx context.Context) string {
+	return m.tableName(ctx) + "_runs"
+}
+
+func (m *Worker) metaTableName(ctx context.Context) string {
+	return m.tableName(ctx) + "_metadata"
+}
+
+// appliedBy returns the identity recorded against each version applied
+// by the worker, which defaults to the name of the operating system user.
+func (m *Worker) appliedBy() string {
+	if m.AppliedBy != "" {
+		return m.AppliedBy
+	}
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return ""
+}
+
+func (m *Worker) seedsTableName(ctx context.Context) string {
+	return m.tableName(ctx) + "_seeds"
+}
+
 func (m *Worker) checkVersion(version VersionID) error {
 	if _, ok := m.schema.definitions[version]; !ok {
-		return fmt.Errorf("invalid schema version id=%d", version)
+		return versionError{Err: ErrInvalidVersion, ID: version}
 	}
 	return nil
 }
@@ -666,13 +2874,73 @@ type versionSummary struct {
 	vmap      map[VersionID]*Version // map version id to version
 }
 
+// steps returns the migration steps required to perform the
+// operation op, which is "up" or "goto".
+func (vs *versionSummary) steps(op string, id VersionID) []*PlannedStep {
+	var steps []*PlannedStep
+	if op == "goto" {
+		for _, plan := range vs.applied {
+			if plan.id > id {
+				steps = append(steps, &PlannedStep{
+					ID:        plan.id,
+					Direction: "down",
+					SQL:       plan.down.describe(),
+				})
+			}
+		}
+	}
+	for _, plan := range vs.unapplied {
+		if op == "up" || plan.id <= id {
+			steps = append(steps, &PlannedStep{
+				ID:        plan.id,
+				Direction: "up",
+				SQL:       plan.up.describe(),
+			})
+		}
+	}
+	return steps
+}
+
+// forcePlan returns the versions whose records are deleted, and the
+// versions whose failures are cleared, when forcing version id.
+func (vs *versionSummary) forcePlan(id VersionID) (deleted []VersionID, cleared []VersionID, err error) {
+	// check for any locked versions that would prevent rolling back
+	if err = vs.checkLocked(id); err != nil {
+		return nil, nil, err
+	}
+
+	if id != 0 {
+		var found bool
+		for _, plan := range vs.applied {
+			if plan.id == id {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return nil, nil, versionError{Err: ErrUnappliedVersion, ID: id}
+		}
+	}
+
+	for _, plan := range vs.applied {
+		ver := vs.vmap[plan.id]
+		if ver.ID > id {
+			deleted = append(deleted, ver.ID)
+		} else if ver.Failed {
+			cleared = append(cleared, ver.ID)
+		}
+	}
+	return deleted, cleared, nil
+}
+
 func (vs *versionSummary) checkLocked(id VersionID) error {
 	for _, applied := range vs.applied {
 		if applied.id <= id {
 			break
 		}
 		if vs.vmap[applied.id].Locked {
-			return fmt.Errorf("database schema version locked id=%d", applied.id)
+			return versionError{Err: ErrVersionLocked, ID: applied.id}
 		}
 	}
 	return nil
@@ -685,7 +2953,7 @@ func (m *Worker) getVersionSummary(ctx context.Context, tx *sql.Tx) (*versionSum
 	}
 	for _, v := range vs.versions {
 		if v.Failed {
-			return nil, errors.New("previously failed")
+			return nil, &FailedError{VersionID: v.ID}
 		}
 	}
 	return vs, nil
@@ -706,6 +2974,9 @@ func (m *Worker) getVersionSummaryAllowFailed(ctx context.Context, tx *sql.Tx) (
 	// prepare set of version ids that have been applied
 	applied := make(map[VersionID]struct{})
 	for _, ver := range vs.versions {
+		if _, ok := m.schema.definitions[ver.ID]; !ok && m.ErrorOnUnknownVersions {
+			return nil, fmt.Errorf("database has applied version %d not present in schema", ver.ID)
+		}
 		if ver.ID > vs.id {
 			vs.id = ver.ID
 		}
@@ -726,20 +2997,9 @@ func (m *Worker) getVersionSummaryAllowFailed(ctx context.Context, tx *sql.Tx) (
 			vs.vmap[ver.ID] = ver
 		}
 
-		if plan.up.dbFunc != nil {
-			ver.Up = "(DBFunc)"
-		} else if plan.up.txFunc != nil {
-			ver.Up = "(TxFunc)"
-		} else {
-			ver.Up = plan.up.sql
-		}
-		if plan.down.dbFunc != nil {
-			ver.Down = "(DBFunc)"
-		} else if plan.down.txFunc != nil {
-			ver.Down = "(TxFunc)"
-		} else {
-			ver.Down = plan.down.sql
-		}
+		ver.Name = plan.name
+		ver.Up = plan.up.describe()
+		ver.Down = plan.down.describe()
 	}
 
 	sort.Slice(vs.applied, func(i, j int) bool {